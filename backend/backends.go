@@ -8,76 +8,111 @@ import (
 	"bytes"
 	"io"
 	"log"
+	"strings"
 	"sync"
 	"time"
 )
 
 const (
 	WRITE_QUEUE = 16
+	// most writes to bisect a batch, lines not sorted out by then are
+	// kept as one dead letter.
+	BISECT_WRITES = 64
 )
 
 type Backends struct {
 	*HttpBackend
 	fb              *FileBackend
-	Interval        int
-	RewriteInterval int
+	dl              *DeadLetter
+	name            string
+	cfg             *BackendConfig
+	Interval        time.Duration
+	RewriteInterval time.Duration
 	MaxRowLimit     int32
 
+	lock             sync.RWMutex
 	running          bool
+	next             *Backends
 	ticker           *time.Ticker
-	ch_write         chan []byte
-	buffer           *bytes.Buffer
+	ch_write         chan writeRequest
+	batches          map[WriteParams]*batch
 	ch_timer         <-chan time.Time
-	write_counter    int32
 	rewriter_running bool
 	wg               sync.WaitGroup
 }
 
+type writeRequest struct {
+	p      []byte
+	params WriteParams
+}
+
+// points buffered with the same params, sent in one request.
+type batch struct {
+	buffer        bytes.Buffer
+	write_counter int32
+}
+
 // maybe ch_timer is not the best way.
 func NewBackends(cfg *BackendConfig, name string) (bs *Backends, err error) {
+	// FIXME: path...
+	fb, err := NewFileBackend(name)
+	if err != nil {
+		return
+	}
+
+	bs = newBackends(cfg, name, fb, NewDeadLetter(name, name))
+	return
+}
+
+func newBackends(cfg *BackendConfig, name string, fb *FileBackend, dl *DeadLetter) (bs *Backends) {
 	bs = &Backends{
-		HttpBackend: NewHttpBackend(cfg),
-		// FIXME: path...
+		HttpBackend:     NewHttpBackend(cfg),
+		fb:              fb,
+		dl:              dl,
+		name:            name,
+		cfg:             cfg,
 		Interval:        cfg.Interval,
 		RewriteInterval: cfg.RewriteInterval,
 		running:         true,
-		ticker:          time.NewTicker(time.Millisecond * time.Duration(cfg.RewriteInterval)),
-		ch_write:        make(chan []byte, 16),
+		ticker:          time.NewTicker(cfg.RewriteInterval),
+		ch_write:        make(chan writeRequest, 16),
+		batches:         make(map[WriteParams]*batch),
 
 		rewriter_running: false,
 		MaxRowLimit:      int32(cfg.MaxRowLimit),
 	}
-	bs.fb, err = NewFileBackend(name)
-	if err != nil {
-		return
-	}
 
 	go bs.worker()
 	return
 }
 
+// Renew creates a Backends with cfg in place of bs. The new one takes over
+// file queue, buffered data and writes still coming to bs, and bs is closed.
+func (bs *Backends) Renew(cfg *BackendConfig) (nbs *Backends) {
+	nbs = newBackends(cfg, bs.name, bs.fb, bs.dl)
+
+	bs.lock.Lock()
+	bs.next = nbs
+	bs.lock.Unlock()
+
+	bs.Close()
+	return
+}
+
+// run until ch_write closed and drained, so nothing written is lost.
 func (bs *Backends) worker() {
-	for bs.running {
+	for {
 		select {
-		case p, ok := <-bs.ch_write:
+		case wr, ok := <-bs.ch_write:
 			if !ok {
 				// closed
-				bs.Flush()
-				bs.wg.Wait()
-				bs.HttpBackend.Close()
-				bs.fb.Close()
+				bs.shutdown()
 				return
 			}
-			bs.WriteBuffer(p)
+			bs.WriteBuffer(wr.p, wr.params)
 
 		case <-bs.ch_timer:
 			bs.Flush()
-			if !bs.running {
-				bs.wg.Wait()
-				bs.HttpBackend.Close()
-				bs.fb.Close()
-				return
-			}
 
 		case <-bs.ticker.C:
 			bs.Idle()
@@ -85,29 +120,68 @@ func (bs *Backends) worker() {
 	}
 }
 
-func (bs *Backends) Write(p []byte) (err error) {
+func (bs *Backends) shutdown() {
+	bs.ticker.Stop()
+	if bs.next == nil {
+		bs.Flush()
+		bs.wg.Wait()
+		bs.HttpBackend.Close()
+		bs.fb.Close()
+		return
+	}
+
+	// renewed, file backend belongs to next now.
+	for params, b := range bs.batches {
+		if b.buffer.Len() == 0 {
+			continue
+		}
+		err := bs.next.Write(b.buffer.Bytes(), params)
+		if err != nil {
+			log.Printf("handover buffer error: %s\n", err)
+		}
+	}
+	bs.batches = nil
+	bs.wg.Wait()
+	bs.HttpBackend.Close()
+}
+
+func (bs *Backends) Write(p []byte, params WriteParams) (err error) {
+	bs.lock.RLock()
+	defer bs.lock.RUnlock()
+
 	if !bs.running {
+		if bs.next != nil {
+			return bs.next.Write(p, params)
+		}
 		return io.ErrClosedPipe
 	}
 
-	bs.ch_write <- p
+	bs.ch_write <- writeRequest{p: p, params: params.batch()}
 	return
 }
 
 func (bs *Backends) Close() (err error) {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+
+	if !bs.running {
+		return
+	}
 	bs.running = false
 	close(bs.ch_write)
 	return
 }
 
-func (bs *Backends) WriteBuffer(p []byte) {
-	bs.write_counter++
-
-	if bs.buffer == nil {
-		bs.buffer = &bytes.Buffer{}
+// WriteBuffer buffers p in the batch of params.
+func (bs *Backends) WriteBuffer(p []byte, params WriteParams) {
+	b, ok := bs.batches[params]
+	if !ok {
+		b = &batch{}
+		bs.batches[params] = b
 	}
+	b.write_counter++
 
-	n, err := bs.buffer.Write(p)
+	n, err := b.buffer.Write(p)
 	if err != nil {
 		log.Printf("error: %s\n", err)
 		return
@@ -119,7 +193,7 @@ func (bs *Backends) WriteBuffer(p []byte) {
 	}
 
 	if p[len(p)-1] != '\n' {
-		_, err = bs.buffer.Write([]byte{'\n'})
+		_, err = b.buffer.Write([]byte{'\n'})
 		if err != nil {
 			log.Printf("error: %s\n", err)
 			return
@@ -127,26 +201,26 @@ func (bs *Backends) WriteBuffer(p []byte) {
 	}
 
 	switch {
-	case bs.write_counter >= bs.MaxRowLimit:
-		bs.Flush()
+	case b.write_counter >= bs.MaxRowLimit:
+		delete(bs.batches, params)
+		bs.flushBatch(b.buffer.Bytes(), params)
 	case bs.ch_timer == nil:
-		bs.ch_timer = time.After(
-			time.Millisecond * time.Duration(bs.Interval))
+		bs.ch_timer = time.After(bs.Interval)
 	}
 
 	return
 }
 
+// Flush sends all batches.
 func (bs *Backends) Flush() {
-	if bs.buffer == nil {
-		return
-	}
-
-	p := bs.buffer.Bytes()
-	bs.buffer = nil
 	bs.ch_timer = nil
-	bs.write_counter = 0
+	for params, b := range bs.batches {
+		delete(bs.batches, params)
+		bs.flushBatch(b.buffer.Bytes(), params)
+	}
+}
 
+func (bs *Backends) flushBatch(p []byte, params WriteParams) {
 	if len(p) == 0 {
 		return
 	}
@@ -155,26 +229,25 @@ func (bs *Backends) Flush() {
 	bs.wg.Add(1)
 	go func() {
 		defer bs.wg.Done()
-		var buf bytes.Buffer
-		err := Compress(&buf, p)
-		if err != nil {
-			log.Printf("write file error: %s\n", err)
-			return
-		}
-
-		p = buf.Bytes()
 
 		// maybe blocked here, run in another goroutine
 		if bs.HttpBackend.IsActive() {
-			err = bs.HttpBackend.WriteCompressed(p)
+			reason, err := bs.HttpBackend.write(p, params)
 			switch err {
 			case nil:
 				return
 			case ErrBadRequest:
-				log.Printf("bad request, drop all data.")
-				return
+				p, err = bs.bisect(p, params, reason)
+				if err == nil {
+					return
+				}
+				log.Printf("bisect error: %s\n", err)
 			case ErrNotFound:
-				log.Printf("bad backend, drop all data.")
+				log.Printf("bad backend, dead letter: %s\n", reason)
+				err = bs.dl.Append(p, params, reason)
+				if err != nil {
+					log.Printf("write dead letter error: %s\n", err)
+				}
 				return
 			default:
 				log.Printf("unknown error %s, maybe overloaded.", err)
@@ -182,7 +255,14 @@ func (bs *Backends) Flush() {
 			log.Printf("write http error: %s\n", err)
 		}
 
-		err = bs.fb.Write(p)
+		var buf bytes.Buffer
+		err := Compress(&buf, p)
+		if err != nil {
+			log.Printf("write file error: %s\n", err)
+			return
+		}
+
+		err = bs.fb.Write(buf.Bytes(), params)
 		if err != nil {
 			log.Printf("write file error: %s\n", err)
 		}
@@ -193,6 +273,84 @@ func (bs *Backends) Flush() {
 	return
 }
 
+// bisect writes lines of p, a batch refused for reason with 400. It's
+// split and halves are written again, till the bad lines are alone, at
+// most BISECT_WRITES writes. Bad lines go to the dead letter file in one
+// letter, and lines not sorted out in another. If the backend fails
+// otherwise, rest is lines not written yet.
+func (bs *Backends) bisect(p []byte, params WriteParams, reason string) (rest []byte, err error) {
+	bi := &bisection{}
+	rest, err = bs.split(bi, p, params, reason)
+
+	if len(bi.bad) > 0 {
+		log.Printf("bad request, dead letter: %s\n", bi.reasons[0])
+		e := bs.dl.Append(bi.bad, params, strings.Join(bi.reasons, "\n"))
+		if e != nil {
+			log.Printf("write dead letter error: %s\n", e)
+		}
+	}
+	if len(bi.left) > 0 {
+		log.Printf("bisect stopped after %d writes, dead letter: %s\n", bi.writes, bi.reason)
+		e := bs.dl.Append(bi.left, params, bi.reason)
+		if e != nil {
+			log.Printf("write dead letter error: %s\n", e)
+		}
+	}
+	return
+}
+
+// state of a bisect, over all splits of a batch.
+type bisection struct {
+	writes  int
+	bad     []byte
+	reasons []string
+	// lines left when writes run out, with reason of the first of them.
+	left   []byte
+	reason string
+}
+
+func (bs *Backends) split(bi *bisection, p []byte, params WriteParams, reason string) (rest []byte, err error) {
+	lines := bytes.SplitAfter(p, []byte{'\n'})
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) <= 1 {
+		bi.bad = append(bi.bad, p...)
+		bi.reasons = append(bi.reasons, reason)
+		return
+	}
+
+	mid := len(lines) / 2
+	halves := [][]byte{bytes.Join(lines[:mid], nil), bytes.Join(lines[mid:], nil)}
+	for i, half := range halves {
+		if bi.writes >= BISECT_WRITES {
+			if len(bi.left) == 0 {
+				bi.reason = reason
+			}
+			bi.left = append(bi.left, half...)
+			continue
+		}
+		bi.writes++
+		reason, err = bs.HttpBackend.write(half, params)
+		switch err {
+		case nil:
+			continue
+		case ErrBadRequest:
+			rest, err = bs.split(bi, half, params, reason)
+			if err == nil {
+				continue
+			}
+		default:
+			rest = half
+		}
+		if i == 0 {
+			rest = append(rest, halves[1]...)
+		}
+		return
+	}
+	return nil, nil
+}
+
 func (bs *Backends) Idle() {
 	if !bs.rewriter_running && bs.fb.IsData() {
 		bs.rewriter_running = true
@@ -208,12 +366,12 @@ func (bs *Backends) RewriteLoop() {
 			return
 		}
 		if !bs.HttpBackend.IsActive() {
-			time.Sleep(time.Millisecond * time.Duration(bs.RewriteInterval))
+			time.Sleep(bs.RewriteInterval)
 			continue
 		}
 		err := bs.Rewrite()
 		if err != nil {
-			time.Sleep(time.Millisecond * time.Duration(bs.RewriteInterval))
+			time.Sleep(bs.RewriteInterval)
 			continue
 		}
 	}
@@ -221,7 +379,11 @@ func (bs *Backends) RewriteLoop() {
 }
 
 func (bs *Backends) Rewrite() (err error) {
-	p, err := bs.fb.Read()
+	// file backend may be shared with a renewed one for a while.
+	bs.fb.rlock.Lock()
+	defer bs.fb.rlock.Unlock()
+
+	p, params, err := bs.fb.Read()
 	if err != nil {
 		return
 	}
@@ -229,16 +391,31 @@ func (bs *Backends) Rewrite() (err error) {
 		return
 	}
 
-	err = bs.HttpBackend.WriteCompressed(p)
+	reason, err := bs.HttpBackend.writeCompressed(p, params)
 
 	switch err {
 	case nil:
 	case ErrBadRequest:
-		log.Printf("bad request, drop all data.")
-		err = nil
+		err = bs.rewriteBisect(p, params, reason)
+		if err != nil {
+			log.Printf("bisect error: %s\n", err)
+			err = bs.fb.RollbackMeta()
+			if err != nil {
+				log.Printf("rollback meta error: %s\n", err)
+			}
+			return
+		}
 	case ErrNotFound:
-		log.Printf("bad backend, drop all data.")
-		err = nil
+		log.Printf("bad backend, dead letter: %s\n", reason)
+		err = bs.deadRecord(p, params, reason)
+		if err != nil {
+			log.Printf("write dead letter error: %s\n", err)
+			err = bs.fb.RollbackMeta()
+			if err != nil {
+				log.Printf("rollback meta error: %s\n", err)
+			}
+			return
+		}
 	default:
 		log.Printf("unknown error %s, maybe overloaded.", err)
 
@@ -256,3 +433,90 @@ func (bs *Backends) Rewrite() (err error) {
 	}
 	return
 }
+
+// rewriteBisect bisects a record p read from file, lines not written are
+// queued to file again.
+func (bs *Backends) rewriteBisect(p []byte, params WriteParams, reason string) (err error) {
+	p, err = Decompress(p)
+	if err != nil {
+		return
+	}
+
+	rest, err := bs.bisect(p, params, reason)
+	if err == nil {
+		return
+	}
+	log.Printf("unknown error %s, maybe overloaded.", err)
+
+	var buf bytes.Buffer
+	err = Compress(&buf, rest)
+	if err != nil {
+		return
+	}
+	return bs.fb.Write(buf.Bytes(), params)
+}
+
+// deadRecord keeps a record p read from file as a dead letter.
+func (bs *Backends) deadRecord(p []byte, params WriteParams, reason string) (err error) {
+	p, err = Decompress(p)
+	if err != nil {
+		return
+	}
+	return bs.dl.Append(p, params, reason)
+}
+
+// DeadLetters gives letters the backend refused.
+func (bs *Backends) DeadLetters() *DeadLetter {
+	return bs.dl
+}
+
+// Replay writes letters of ids again, all if no id given, and drops
+// those written. A letter refused again is kept, replayed stops at other
+// errors of backend.
+func (bs *Backends) Replay(ids ...int64) (replayed int, failed int, err error) {
+	var letters []*Letter
+	if len(ids) == 0 {
+		letters, err = bs.dl.List()
+		if err != nil {
+			return
+		}
+	}
+	for _, id := range ids {
+		var letter *Letter
+		letter, err = bs.dl.Get(id)
+		if err != nil {
+			return
+		}
+		letters = append(letters, letter)
+	}
+
+	var done []int64
+	defer func() {
+		if len(done) == 0 {
+			return
+		}
+		if rerr := bs.dl.Remove(done...); rerr != nil && err == nil {
+			err = rerr
+		}
+	}()
+
+	for _, letter := range letters {
+		var params WriteParams
+		params, err = letter.WriteParams()
+		if err != nil {
+			return
+		}
+		_, err = bs.HttpBackend.write([]byte(letter.Lines), params)
+		switch err {
+		case nil:
+			done = append(done, letter.ID)
+			replayed++
+		case ErrBadRequest, ErrNotFound:
+			failed++
+			err = nil
+		default:
+			return
+		}
+	}
+	return
+}
@@ -5,6 +5,19 @@
 package backend
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -19,13 +32,13 @@ func TestCache(t *testing.T) {
 	}
 	defer bs.Close()
 
-	err = bs.Write([]byte("cpu,host=server01,region=uswest value=1 1434055562000000000"))
+	err = bs.Write([]byte("cpu,host=server01,region=uswest value=1 1434055562000000000"), WriteParams{})
 	if err != nil {
 		t.Errorf("error: %s", err)
 		return
 	}
 
-	err = bs.Write([]byte("cpu value=3,value2=4 1434055562000010000"))
+	err = bs.Write([]byte("cpu value=3,value2=4 1434055562000010000"), WriteParams{})
 	if err != nil {
 		t.Errorf("error: %s", err)
 		return
@@ -45,7 +58,7 @@ func TestRewrite(t *testing.T) {
 	}
 	defer bs.Close()
 	for i := 0; i < 100; i++ {
-		err := bs.fb.Write([]byte("cpu value=3,value2=4 1434055562000010000"))
+		err := bs.fb.Write([]byte("cpu value=3,value2=4 1434055562000010000"), WriteParams{})
 		if err != nil {
 			t.Errorf("error: %s", err)
 			return
@@ -53,3 +66,147 @@ func TestRewrite(t *testing.T) {
 	}
 	time.Sleep(2 * time.Second)
 }
+
+func TestBackendsParams(t *testing.T) {
+	var lock sync.Mutex
+	queries := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			lock.Lock()
+			queries[req.URL.RawQuery]++
+			lock.Unlock()
+		}
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	cfg, _ := CreateTestBackendConfig("params")
+	cfg.URL = ts.URL
+	bs, err := NewBackends(cfg, "params")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	for _, params := range []WriteParams{
+		{DB: "a"},
+		{DB: "b"},
+		{DB: "a", Precision: "s", RP: "week"},
+		{Precision: "s", RP: "week"},
+	} {
+		err = bs.Write([]byte("cpu value=1 1000"), params)
+		if err != nil {
+			t.Fatalf("error: %s", err)
+		}
+	}
+	bs.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+	want := map[string]int{"db=params": 1, "db=params&precision=s&rp=week": 1}
+	if !reflect.DeepEqual(queries, want) {
+		t.Errorf("batches wrong: %v", queries)
+	}
+}
+
+func TestBackendsBisect(t *testing.T) {
+	var lock sync.Mutex
+	var written []string
+	var writes int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/write" {
+			w.WriteHeader(204)
+			return
+		}
+		atomic.AddInt32(&writes, 1)
+		zip, _ := gzip.NewReader(req.Body)
+		p, _ := ioutil.ReadAll(zip)
+		lines := strings.Split(strings.TrimSpace(string(p)), "\n")
+		for _, line := range lines {
+			if strings.Contains(line, "bad") {
+				w.WriteHeader(400)
+				w.Write([]byte(`{"error":"unable to parse '` + line + `'"}`))
+				return
+			}
+			if strings.Contains(line, "down") {
+				w.WriteHeader(503)
+				return
+			}
+		}
+		lock.Lock()
+		written = append(written, lines...)
+		lock.Unlock()
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	cfg, _ := CreateTestBackendConfig("bisect")
+	cfg.URL = ts.URL
+	bs, err := NewBackends(cfg, "bisect")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer bs.Close()
+	defer os.Remove("bisect.dead")
+
+	p := []byte("cpu value=1\ncpu value=2\ncpu bad=3\ncpu value=4\ncpu value=5\ncpu bad=6\ncpu value=7\n")
+	rest, err := bs.bisect(p, WriteParams{RP: "week"}, "first")
+	if err != nil || rest != nil {
+		t.Fatalf("bisect wrong: %s %v", rest, err)
+	}
+	lock.Lock()
+	sort.Strings(written)
+	want := []string{"cpu value=1", "cpu value=2", "cpu value=4", "cpu value=5", "cpu value=7"}
+	if !reflect.DeepEqual(written, want) {
+		t.Errorf("written wrong: %v", written)
+	}
+	lock.Unlock()
+
+	f, err := os.Open("bisect.dead")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer f.Close()
+	var letters []Letter
+	dec := json.NewDecoder(f)
+	for {
+		var letter Letter
+		if dec.Decode(&letter) != nil {
+			break
+		}
+		letters = append(letters, letter)
+	}
+	// bad lines in one letter.
+	if len(letters) != 1 || letters[0].Lines != "cpu bad=3\ncpu bad=6\n" || letters[0].Points != 2 ||
+		letters[0].Reason != "unable to parse 'cpu bad=3'\nunable to parse 'cpu bad=6'" || letters[0].Params != "rp=week" {
+		t.Errorf("dead letters wrong: %+v", letters)
+	}
+
+	// lines not tried yet are left when backend goes down.
+	rest, err = bs.bisect([]byte("cpu bad=1\ncpu down=2\ncpu value=3\ncpu value=4\n"), WriteParams{}, "first")
+	if err != ErrUnknown || string(rest) != "cpu down=2\ncpu value=3\ncpu value=4\n" {
+		t.Errorf("rest wrong: %q %v", rest, err)
+	}
+
+	// writes are limited, lines left are one letter.
+	err = bs.DeadLetters().Remove()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	atomic.StoreInt32(&writes, 0)
+	var buf bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&buf, "cpu bad=%d\n", i)
+	}
+	rest, err = bs.bisect(buf.Bytes(), WriteParams{}, "first")
+	if err != nil || rest != nil {
+		t.Fatalf("bisect wrong: %s %v", rest, err)
+	}
+	if n := atomic.LoadInt32(&writes); n > BISECT_WRITES {
+		t.Errorf("%d writes to bisect", n)
+	}
+	dead, err := bs.DeadLetters().List()
+	if err != nil || len(dead) != 2 || dead[0].Points+dead[1].Points != 1000 {
+		t.Errorf("dead letters wrong: %v %v", dead, err)
+	}
+}
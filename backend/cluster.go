@@ -9,9 +9,14 @@ import (
 	"errors"
 	"io"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -25,6 +30,20 @@ var (
 	ErrClosed          = errors.New("write in a closed file")
 	ErrBackendNotExist = errors.New("use a backend not exists")
 	ErrQueryForbidden  = errors.New("query forbidden")
+	// same messages as influxdb.
+	ErrIllegalPrecision   = errors.New("invalid precision")
+	ErrIllegalConsistency = errors.New("invalid consistency")
+	ErrIllegalTimestamp   = errors.New("illegal timestamp")
+	ErrFutureTimestamp    = errors.New("timestamp too far in the future")
+	ErrWriteFailed        = errors.New("write failed")
+)
+
+const (
+	// at most so many unrouted measurements are remembered.
+	MAX_UNROUTED = 10000
+	// at most so many rejected lines or unrouted measurements are told
+	// in a partial write error.
+	MAX_REJECTED = 100
 )
 
 func ScanKey(pointbuf []byte) (key string, err error) {
@@ -64,21 +83,96 @@ func TrimRight(p []byte, s []byte) (r []byte) {
 
 type InfluxCluster struct {
 	lock           sync.RWMutex
+	reload_lock    sync.Mutex
+	update_lock    sync.Mutex
+	version        int64
 	Zone           string
-	nexts          string
+	nexts          []string
 	query_executor Querier
 	ForbiddenQuery []*regexp.Regexp
 	ObligatedQuery []*regexp.Regexp
-	cfgsrc         *RedisConfigSource
+	cfgsrc         ConfigSource
 	bas            []BackendAPI
 	backends       map[string]BackendAPI
-	m2bs           map[string][]BackendAPI // measurements to backends
+	router         *Router // measurements to backends
+	rewriter       *Rewriter
+	filter         *Filter
 	stats          *Statistics
 	counter        *Statistics
 	ticker         *time.Ticker
 	defaultTags    map[string]string
-	WriteTracing   int
-	QueryTracing   int
+	WriteTracing   bool
+	QueryTracing   bool
+	autoregister   bool
+	future_limit   time.Duration
+	future_clamp   bool
+	unrouted_lock  sync.Mutex
+	unrouted       map[string]bool // recorded or dismissed, or not yet
+}
+
+// WriteParams are parameters of a write request. DB is the database of
+// client, for routing, backends write to their own db. Addr is ip of
+// client, for filters.
+type WriteParams struct {
+	DB          string
+	Precision   string
+	RP          string
+	Consistency string
+	Addr        string
+}
+
+// nanoseconds in a unit of every write precision.
+var Precisions = map[string]int64{
+	"":   1,
+	"n":  1,
+	"ns": 1,
+	"u":  int64(time.Microsecond),
+	"us": int64(time.Microsecond),
+	"ms": int64(time.Millisecond),
+	"s":  int64(time.Second),
+	"m":  int64(time.Minute),
+	"h":  int64(time.Hour),
+}
+
+var consistencies = map[string]bool{"": true, "any": true, "one": true, "quorum": true, "all": true}
+
+// ParseWriteParams reads db, precision, rp and consistency of a write.
+func ParseWriteParams(q url.Values) (params WriteParams, err error) {
+	params = WriteParams{
+		DB:          q.Get("db"),
+		Precision:   q.Get("precision"),
+		RP:          q.Get("rp"),
+		Consistency: q.Get("consistency"),
+	}
+	if _, ok := Precisions[params.Precision]; !ok {
+		return params, ErrIllegalPrecision
+	}
+	if !consistencies[params.Consistency] {
+		return params, ErrIllegalConsistency
+	}
+	return
+}
+
+// Values gives params to pass to backends, db not included.
+func (params WriteParams) Values() (q url.Values) {
+	q = url.Values{}
+	if params.Precision != "" {
+		q.Set("precision", params.Precision)
+	}
+	if params.RP != "" {
+		q.Set("rp", params.RP)
+	}
+	if params.Consistency != "" {
+		q.Set("consistency", params.Consistency)
+	}
+	return
+}
+
+// batch params, points written with different ones can't be sent together.
+func (params WriteParams) batch() WriteParams {
+	params.DB = ""
+	params.Addr = ""
+	return params
 }
 
 type Statistics struct {
@@ -94,19 +188,26 @@ type Statistics struct {
 	QueryRequestDuration int64
 }
 
-func NewInfluxCluster(cfgsrc *RedisConfigSource, nodecfg *NodeConfig) (ic *InfluxCluster) {
+func NewInfluxCluster(cfgsrc ConfigSource, nodecfg *NodeConfig) (ic *InfluxCluster) {
 	ic = &InfluxCluster{
 		Zone:           nodecfg.Zone,
 		nexts:          nodecfg.Nexts,
 		query_executor: &InfluxQLExecutor{},
 		cfgsrc:         cfgsrc,
 		bas:            make([]BackendAPI, 0),
+		router:         NewRouter(),
+		rewriter:       &Rewriter{},
+		filter:         &Filter{},
 		stats:          &Statistics{},
 		counter:        &Statistics{},
 		ticker:         time.NewTicker(10 * time.Second),
 		defaultTags:    map[string]string{"addr": nodecfg.ListenAddr},
 		WriteTracing:   nodecfg.WriteTracing,
 		QueryTracing:   nodecfg.QueryTracing,
+		autoregister:   nodecfg.AutoRegister,
+		future_limit:   nodecfg.FutureLimit,
+		future_clamp:   nodecfg.FutureAction == "clamp",
+		unrouted:       make(map[string]bool),
 	}
 	host, err := os.Hostname()
 	if err != nil {
@@ -114,7 +215,7 @@ func NewInfluxCluster(cfgsrc *RedisConfigSource, nodecfg *NodeConfig) (ic *Influ
 	}
 	ic.defaultTags["host"] = host
 	if nodecfg.Interval > 0 {
-		ic.ticker = time.NewTicker(time.Second * time.Duration(nodecfg.Interval))
+		ic.ticker = time.NewTicker(nodecfg.Interval)
 	}
 
 	err = ic.ForbidQuery(ForbidCmds)
@@ -137,6 +238,7 @@ func (ic *InfluxCluster) statistics() {
 	// how to quit
 	for {
 		<-ic.ticker.C
+		ic.recordUnrouted()
 		ic.Flush()
 		ic.counter = (*Statistics)(atomic.SwapPointer((*unsafe.Pointer)(unsafe.Pointer(&ic.stats)),
 			unsafe.Pointer(ic.counter)))
@@ -147,6 +249,142 @@ func (ic *InfluxCluster) statistics() {
 	}
 }
 
+// noteUnrouted remembers key has no route, or only a catch-all one.
+// It is named like route key "db:mydb/key" if db has routes of its own.
+func (ic *InfluxCluster) noteUnrouted(router *Router, db string, key string) {
+	name := key
+	if db != "" && router.HasDB(db) {
+		name = RouteDBKey(db, key)
+	}
+
+	ic.unrouted_lock.Lock()
+	defer ic.unrouted_lock.Unlock()
+	if _, ok := ic.unrouted[name]; ok || len(ic.unrouted) >= MAX_UNROUTED {
+		return
+	}
+	log.Printf("unrouted measurement: %s\n", name)
+	ic.unrouted[name] = false
+}
+
+// recordUnrouted saves newly seen unrouted measurements to source.
+func (ic *InfluxCluster) recordUnrouted() {
+	recorder, ok := ic.cfgsrc.(UnroutedRecorder)
+	if !ok {
+		return
+	}
+
+	ic.unrouted_lock.Lock()
+	defer ic.unrouted_lock.Unlock()
+	var names []string
+	for name, recorded := range ic.unrouted {
+		if !recorded {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+
+	err := recorder.RecordUnrouted(names)
+	if err != nil {
+		log.Printf("record unrouted error: %s", err)
+		return
+	}
+	for _, name := range names {
+		ic.unrouted[name] = true
+	}
+}
+
+// Unrouted lists measurements written without a route, or only with a
+// catch-all route. Those routed by now are dropped from the list.
+func (ic *InfluxCluster) Unrouted() (names []string, err error) {
+	recorder, ok := ic.cfgsrc.(UnroutedRecorder)
+	if ok {
+		ic.recordUnrouted()
+		names, err = recorder.LoadUnrouted()
+		if err != nil {
+			return
+		}
+	} else {
+		ic.unrouted_lock.Lock()
+		for name, dismissed := range ic.unrouted {
+			if !dismissed {
+				names = append(names, name)
+			}
+		}
+		ic.unrouted_lock.Unlock()
+		sort.Strings(names)
+	}
+
+	router := ic.getRouter()
+	var routed []string
+	pending := names[:0]
+	for _, name := range names {
+		db, key := SplitRouteDB(name)
+		route, ok := router.MatchSeries(db, key, nil)
+		if ok && !router.IsFallback(db, route) {
+			routed = append(routed, name)
+			continue
+		}
+		pending = append(pending, name)
+	}
+	if len(routed) > 0 {
+		err = ic.DismissUnrouted(routed...)
+	}
+	return pending, err
+}
+
+// DismissUnrouted removes names from the unrouted list. They are not
+// recorded again by this node until restart.
+func (ic *InfluxCluster) DismissUnrouted(names ...string) (err error) {
+	ic.unrouted_lock.Lock()
+	for _, name := range names {
+		ic.unrouted[name] = true
+	}
+	ic.unrouted_lock.Unlock()
+
+	if recorder, ok := ic.cfgsrc.(UnroutedRecorder); ok {
+		err = recorder.RemoveUnrouted(names)
+	}
+	return
+}
+
+// BackendsOf gives backends of name, for its dead letters.
+func (ic *InfluxCluster) BackendsOf(name string) (bs *Backends, err error) {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	bs, ok := ic.backends[name].(*Backends)
+	if !ok {
+		return nil, ErrBackendNotExist
+	}
+	return
+}
+
+// DeadLetters gives letters of all backends having any, lines left out.
+func (ic *InfluxCluster) DeadLetters() (letters map[string][]*Letter, err error) {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	letters = make(map[string][]*Letter)
+	for name, b := range ic.backends {
+		bs, ok := b.(*Backends)
+		if !ok {
+			continue
+		}
+		var l []*Letter
+		l, err = bs.DeadLetters().List()
+		if err != nil {
+			return
+		}
+		for _, letter := range l {
+			letter.Lines = ""
+		}
+		if len(l) > 0 {
+			letters[name] = l
+		}
+	}
+	return
+}
+
 func (ic *InfluxCluster) Flush() {
 	ic.counter.QueryRequests = 0
 	ic.counter.QueryRequestsFail = 0
@@ -182,7 +420,36 @@ func (ic *InfluxCluster) WriteStatistics() (err error) {
 	if err != nil {
 		return
 	}
-	return ic.Write([]byte(line + "\n"))
+	lines := line + "\n"
+
+	for _, rs := range []struct {
+		name   string
+		field  string
+		deltas map[string]int64
+	}{
+		{"influxdb.rewrite", "statPointsRewritten", ic.getRewriter().deltas()},
+		{"influxdb.filter", "statPointsDropped", ic.getFilter().deltas()},
+	} {
+		for rule, count := range rs.deltas {
+			tags := map[string]string{"rule": rule}
+			for k, v := range ic.defaultTags {
+				tags[k] = v
+			}
+			metric = &monitor.Metric{
+				Name:   rs.name,
+				Tags:   tags,
+				Fields: map[string]interface{}{rs.field: count},
+				Time:   metric.Time,
+			}
+			line, err = metric.ParseToLine()
+			if err != nil {
+				return
+			}
+			lines += line + "\n"
+		}
+	}
+	_, err = ic.Write([]byte(lines), WriteParams{})
+	return
 }
 
 func (ic *InfluxCluster) ForbidQuery(s string) (err error) {
@@ -216,80 +483,200 @@ func (ic *InfluxCluster) AddNext(ba BackendAPI) {
 	return
 }
 
-func (ic *InfluxCluster) loadBackends() (backends map[string]BackendAPI, bas []BackendAPI, err error) {
-	backends = make(map[string]BackendAPI)
-
-	bkcfgs, err := ic.cfgsrc.LoadBackends()
-	if err != nil {
-		return
-	}
-
-	for name, cfg := range bkcfgs {
-		backends[name], err = NewBackends(cfg, name)
+// patterns in route keys must compile, before anything changed.
+func (ic *InfluxCluster) checkRoutes(m_map map[string][]string) (err error) {
+	for name := range m_map {
+		err = CheckRoute(name)
 		if err != nil {
-			log.Printf("create backend error: %s", err)
+			log.Printf("illegal route m:%s: %s", name, err)
 			return
 		}
 	}
+	return
+}
 
-	if ic.nexts != "" {
-		for _, nextname := range strings.Split(ic.nexts, ",") {
-			ba, ok := backends[nextname]
-			if !ok {
-				err = ErrBackendNotExist
-				log.Println(nextname, err)
-				continue
+// Backends with unchanged config are kept, changed ones are renewed and
+// take over data of the old ones. Return backends to be closed.
+func (ic *InfluxCluster) loadBackends(bkcfgs map[string]*BackendConfig, orig_backends map[string]BackendAPI) (backends map[string]BackendAPI, bas []BackendAPI, removed map[string]BackendAPI, err error) {
+	backends = make(map[string]BackendAPI)
+	removed = make(map[string]BackendAPI)
+
+	renews := make(map[string]*Backends)
+	for name, cfg := range bkcfgs {
+		ba, ok := orig_backends[name]
+		if !ok {
+			backends[name], err = NewBackends(cfg, name)
+			if err != nil {
+				log.Printf("create backend error: %s", err)
+				for _, ba = range backends {
+					ba.Close()
+				}
+				return
 			}
-			bas = append(bas, ba)
+			log.Printf("backend %s created.", name)
+			continue
+		}
+
+		bs, ok := ba.(*Backends)
+		switch {
+		case !ok:
+			backends[name] = ba
+		case reflect.DeepEqual(bs.cfg, cfg):
+			backends[name] = bs
+		default:
+			renews[name] = bs
 		}
 	}
 
-	return
-}
+	// do this after all creations, they may fail.
+	for name, bs := range renews {
+		backends[name] = bs.Renew(bkcfgs[name])
+		log.Printf("backend %s renewed.", name)
+	}
 
-func (ic *InfluxCluster) loadMeasurements(backends map[string]BackendAPI) (m2bs map[string][]BackendAPI, err error) {
-	m2bs = make(map[string][]BackendAPI)
+	for name, ba := range orig_backends {
+		if _, ok := bkcfgs[name]; !ok {
+			removed[name] = ba
+		}
+	}
 
-	m_map, err := ic.cfgsrc.LoadMeasurements()
-	if err != nil {
-		return
+	for _, nextname := range ic.nexts {
+		ba, ok := backends[nextname]
+		if !ok {
+			log.Println(nextname, ErrBackendNotExist)
+			continue
+		}
+		bas = append(bas, ba)
 	}
+	return
+}
 
+func (ic *InfluxCluster) loadMeasurements(m_map map[string][]string, backends map[string]BackendAPI) (router *Router) {
+	router = NewRouter()
 	for name, bs_names := range m_map {
-		var bss []BackendAPI
-		for _, bs_name := range bs_names {
-			bs, ok := backends[bs_name]
-			if !ok {
-				err = ErrBackendNotExist
-				log.Println(bs_name, err)
+		groups, sharded := SplitGroups(bs_names)
+		var bss [][]BackendAPI
+		var names []string
+		for _, group := range groups {
+			var bs []BackendAPI
+			for _, bs_name := range group {
+				ba, ok := backends[bs_name]
+				if !ok {
+					log.Println(bs_name, ErrBackendNotExist)
+					continue
+				}
+				bs = append(bs, ba)
+			}
+			// a group without any backend left takes no series, a
+			// measurement without any has no route, its points are
+			// unrouted but not dropped silently.
+			if len(bs) == 0 {
 				continue
 			}
 			bss = append(bss, bs)
+			names = append(names, strings.Join(group, ","))
 		}
-		m2bs[name] = bss
+		if len(bss) == 0 {
+			log.Printf("measurement %s has no backend", name)
+			continue
+		}
+
+		route := NewRoute(bss[0])
+		if sharded {
+			route = NewShardedRoute(names, bss)
+		}
+		// checked by checkRoutes.
+		router.Add(name, route)
 	}
 	return
 }
 
 func (ic *InfluxCluster) LoadConfig() (err error) {
-	backends, bas, err := ic.loadBackends()
+	ic.reload_lock.Lock()
+	defer ic.reload_lock.Unlock()
+
+	if rcs, ok := ic.cfgsrc.(RefreshableConfigSource); ok {
+		err = rcs.Refresh()
+		if err != nil {
+			return
+		}
+	}
+
+	// read version first, a change during loading will cause another reload.
+	var version int64
+	if vcs, ok := ic.cfgsrc.(VersionedConfigSource); ok {
+		version, err = vcs.Version()
+		if err != nil {
+			return
+		}
+	}
+
+	bkcfgs, err := ic.cfgsrc.LoadBackends()
 	if err != nil {
 		return
 	}
 
-	m2bs, err := ic.loadMeasurements(backends)
+	m_map, err := ic.cfgsrc.LoadMeasurements()
 	if err != nil {
 		return
 	}
 
-	ic.lock.Lock()
+	err = ic.checkRoutes(m_map)
+	if err != nil {
+		return
+	}
+
+	rewriter := &Rewriter{}
+	if rws, ok := ic.cfgsrc.(RewriteSource); ok {
+		var rewrites map[string]*RewriteConfig
+		rewrites, err = rws.LoadRewrites()
+		if err != nil {
+			return
+		}
+		rewriter, err = NewRewriter(rewrites)
+		if err != nil {
+			log.Printf("illegal rewrite: %s", err)
+			return
+		}
+	}
+
+	filter := &Filter{}
+	if fs, ok := ic.cfgsrc.(FilterSource); ok {
+		var filters map[string]*FilterConfig
+		filters, err = fs.LoadFilters()
+		if err != nil {
+			return
+		}
+		filter, err = NewFilter(filters)
+		if err != nil {
+			log.Printf("illegal filter: %s", err)
+			return
+		}
+	}
+
+	ic.lock.RLock()
 	orig_backends := ic.backends
+	rewriter.Inherit(ic.rewriter)
+	filter.Inherit(ic.filter)
+	ic.lock.RUnlock()
+
+	backends, bas, removed, err := ic.loadBackends(bkcfgs, orig_backends)
+	if err != nil {
+		return
+	}
+
+	router := ic.loadMeasurements(m_map, backends)
+
+	ic.lock.Lock()
 	ic.backends = backends
 	ic.bas = bas
-	ic.m2bs = m2bs
+	ic.router = router
+	ic.rewriter = rewriter
+	ic.filter = filter
+	ic.version = version
 	ic.lock.Unlock()
 
-	for name, bs := range orig_backends {
+	for name, bs := range removed {
 		err = bs.Close()
 		if err != nil {
 			log.Printf("fail in close backend %s", name)
@@ -298,6 +685,93 @@ func (ic *InfluxCluster) LoadConfig() (err error) {
 	return
 }
 
+// Version of config running, 0 if source not versioned.
+func (ic *InfluxCluster) Version() (version int64) {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	return ic.version
+}
+
+// Rollback makes snapshot of version the live config in source, and
+// reloads. Other nodes watching the source will follow.
+func (ic *InfluxCluster) Rollback(version int64) (err error) {
+	vcs, ok := ic.cfgsrc.(VersionedConfigSource)
+	if !ok {
+		return ErrNotVersioned
+	}
+
+	err = vcs.Rollback(version)
+	if err != nil {
+		return
+	}
+	return ic.LoadConfig()
+}
+
+// RawConfig loads the whole config from source.
+func (ic *InfluxCluster) RawConfig() (raw *RawConfig, err error) {
+	rcs, ok := ic.cfgsrc.(RawConfigSource)
+	if !ok {
+		return nil, ErrNotValidatable
+	}
+	return rcs.LoadRaw()
+}
+
+// UpdateConfig changes config in source by fn, saves and loads it if it
+// is still valid. report tells why if not.
+func (ic *InfluxCluster) UpdateConfig(fn func(raw *RawConfig) error) (report *ConfigReport, err error) {
+	wcs, ok := ic.cfgsrc.(WritableConfigSource)
+	if !ok {
+		return nil, ErrNotWritable
+	}
+
+	ic.update_lock.Lock()
+	defer ic.update_lock.Unlock()
+
+	raw, err := wcs.LoadRaw()
+	if err != nil {
+		return
+	}
+
+	err = fn(raw)
+	if err != nil {
+		return
+	}
+
+	report = ValidateConfig(raw)
+	if !report.Valid {
+		return report, ErrIllegalConfig
+	}
+
+	err = wcs.SaveRaw(raw)
+	if err != nil {
+		return
+	}
+	err = ic.LoadConfig()
+	return
+}
+
+// ValidateConfig checks config in source without applying it.
+func (ic *InfluxCluster) ValidateConfig() (report *ConfigReport, err error) {
+	return CheckConfigSource(ic.cfgsrc)
+}
+
+// WatchConfig reloads when config source reports changes, changes in
+// delay will be merged into one reload.
+func (ic *InfluxCluster) WatchConfig(delay time.Duration) (err error) {
+	watcher, ok := ic.cfgsrc.(ConfigWatcher)
+	if !ok {
+		return ErrNotWatchable
+	}
+
+	return watcher.Watch(Debounce(delay, func() {
+		log.Printf("config changed, reload.")
+		err := ic.LoadConfig()
+		if err != nil {
+			log.Printf("reload config error: %s", err)
+		}
+	}))
+}
+
 func (ic *InfluxCluster) Ping() (version string, err error) {
 	atomic.AddInt64(&ic.stats.PingRequests, 1)
 	version = VERSION
@@ -328,22 +802,45 @@ func (ic *InfluxCluster) CheckQuery(q string) (err error) {
 	return
 }
 
-func (ic *InfluxCluster) GetBackends(key string) (backends []BackendAPI, ok bool) {
+func (ic *InfluxCluster) getRouter() (router *Router) {
 	ic.lock.RLock()
 	defer ic.lock.RUnlock()
+	return ic.router
+}
 
-	backends, ok = ic.m2bs[key]
-	// match use prefix
+func (ic *InfluxCluster) getRewriter() (rewriter *Rewriter) {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	return ic.rewriter
+}
+
+// RewriteCounts gives points touched by every rewrite rule.
+func (ic *InfluxCluster) RewriteCounts() map[string]int64 {
+	return ic.getRewriter().RewriteCounts()
+}
+
+func (ic *InfluxCluster) getFilter() (filter *Filter) {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	return ic.filter
+}
+
+// DropCounts gives points dropped by every filter rule.
+func (ic *InfluxCluster) DropCounts() map[string]int64 {
+	return ic.getFilter().DropCounts()
+}
+
+// HasDB tells if there are routes for database db.
+func (ic *InfluxCluster) HasDB(db string) bool {
+	return ic.getRouter().HasDB(db)
+}
+
+func (ic *InfluxCluster) GetBackends(key string) (backends []BackendAPI, ok bool) {
+	route, ok := ic.getRouter().Match(key)
 	if !ok {
-		for k, v := range ic.m2bs {
-			if strings.HasPrefix(key, k) {
-				backends = v
-				ok = true
-				break
-			}
-		}
+		return
 	}
-	return
+	return route.Backends(), true
 }
 
 func (ic *InfluxCluster) Query(w http.ResponseWriter, req *http.Request) (err error) {
@@ -392,7 +889,9 @@ func (ic *InfluxCluster) Query(w http.ResponseWriter, req *http.Request) (err er
 		return
 	}
 
-	apis, ok := ic.GetBackends(key)
+	// tags pinned in where go to backends of the tag route, others to
+	// every route the points may be in.
+	routes, ok := ic.getRouter().MatchQuery(req.FormValue("db"), key, GetTagsFromInfluxQL(q))
 	if !ok {
 		log.Printf("unknown measurement: %s,the query is %s\n", key, q)
 		w.WriteHeader(400)
@@ -401,7 +900,25 @@ func (ic *InfluxCluster) Query(w http.ResponseWriter, req *http.Request) (err er
 		return
 	}
 
-	// same zone first, other zone. pass non-active.
+	groups, err := RouteGroups(routes)
+	if err == nil {
+		if len(groups) > 1 {
+			err = ic.queryShards(w, req, groups)
+		} else {
+			err = ic.queryGroup(w, req, groups[0])
+		}
+	}
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
+		return
+	}
+	return
+}
+
+// query one of apis. same zone first, other zone. pass non-active.
+func (ic *InfluxCluster) queryGroup(w http.ResponseWriter, req *http.Request, apis []BackendAPI) (err error) {
 	// TODO: better way?
 
 	for _, api := range apis {
@@ -430,15 +947,113 @@ func (ic *InfluxCluster) Query(w http.ResponseWriter, req *http.Request) (err er
 		}
 	}
 
-	w.WriteHeader(400)
-	w.Write([]byte("query error"))
-	atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
+	return ErrQueryFailed
+}
+
+// query every replica group of a sharded measurement, or of several
+// routes, merge the results.
+func (ic *InfluxCluster) queryShards(w http.ResponseWriter, req *http.Request, groups [][]BackendAPI) (err error) {
+	if req.FormValue("chunked") == "true" {
+		return ErrChunkedShard
+	}
+	err = CheckShardQuery(req.FormValue("q"))
+	if err != nil {
+		return
+	}
+
+	rbs := make([]*responseBuffer, len(groups))
+	errs := make([]error, len(groups))
+	var wg sync.WaitGroup
+	for i, group := range groups {
+		// every backend changes url and form of req.
+		r := req.WithContext(req.Context())
+		r.Form = make(url.Values, len(req.Form))
+		for k, v := range req.Form {
+			r.Form[k] = v
+		}
+		r.Header = make(http.Header, len(req.Header))
+		copyHeader(r.Header, req.Header)
+		// gzip can't be merged.
+		r.Header.Del("Accept-Encoding")
+
+		rbs[i] = newResponseBuffer()
+		wg.Add(1)
+		go func(i int, group []BackendAPI) {
+			defer wg.Done()
+			errs[i] = ic.queryGroup(rbs[i], r, group)
+		}(i, group)
+	}
+	wg.Wait()
+
+	bodies := make([][]byte, len(groups))
+	for i, rb := range rbs {
+		if errs[i] != nil {
+			return errs[i]
+		}
+		// pass the first error to client as it is.
+		if rb.code != 200 {
+			copyHeader(w.Header(), rb.header)
+			w.WriteHeader(rb.code)
+			w.Write(rb.body.Bytes())
+			return
+		}
+		bodies[i] = rb.body.Bytes()
+	}
+
+	p, err := MergeQueryResults(bodies)
+	if err != nil {
+		log.Printf("merge query results error: %s", err)
+		return ErrQueryFailed
+	}
+
+	copyHeader(w.Header(), rbs[0].header)
+	w.Header().Del("Content-Length")
+	w.WriteHeader(200)
+	w.Write(p)
+	return
+}
+
+// NormalizeTime makes Time of p in nanoseconds by precision, or now if
+// it has none. A timestamp later than now plus future_limit is rejected,
+// or clamped to it. changed tells if p.Time is set.
+func (ic *InfluxCluster) NormalizeTime(p *Point, precision string, now time.Time) (changed bool, err error) {
+	changed = p.Time == nil
+	ts := now.UnixNano()
+	if p.Time != nil {
+		ts, err = strconv.ParseInt(string(p.Time), 10, 64)
+		if err != nil {
+			return false, ErrIllegalTimestamp
+		}
+		if mul := Precisions[precision]; mul != 1 {
+			if ts > math.MaxInt64/mul || ts < math.MinInt64/mul {
+				return false, ErrIllegalTimestamp
+			}
+			ts *= mul
+			changed = true
+		}
+	}
+
+	if ic.future_limit > 0 {
+		limit := now.Add(ic.future_limit).UnixNano()
+		if ts > limit {
+			if !ic.future_clamp {
+				return false, ErrFutureTimestamp
+			}
+			ts = limit
+			changed = true
+		}
+	}
+
+	if changed {
+		p.Time = strconv.AppendInt(nil, ts, 10)
+	}
 	return
 }
 
 // Wrong in one row will not stop others.
-// So don't try to return error, just print it.
-func (ic *InfluxCluster) WriteRow(line []byte) {
+// What happened to the row is accounted in result.
+// now is when the request received, for points without timestamp.
+func (ic *InfluxCluster) WriteRow(line []byte, params WriteParams, now time.Time, result *WriteResult) {
 	atomic.AddInt64(&ic.stats.PointsWritten, 1)
 	// maybe trim?
 	line = bytes.TrimRight(line, " \t\r\n")
@@ -448,40 +1063,116 @@ func (ic *InfluxCluster) WriteRow(line []byte) {
 		return
 	}
 
-	key, err := ScanKey(line)
+	p, err := ParsePoint(line)
+	if err != nil {
+		atomic.AddInt64(&ic.stats.PointsWrittenFail, 1)
+		result.reject(line, err)
+		return
+	}
+
+	if filter := ic.getFilter(); filter.Len() > 0 && filter.Drop(params.DB, params.Addr, p) {
+		result.Filtered++
+		return
+	}
+
+	// rewrite before routing, measurement may change.
+	changed := false
+	if rewriter := ic.getRewriter(); rewriter.Len() > 0 {
+		var ok bool
+		changed, ok = rewriter.Rewrite(params.DB, p)
+		// all fields dropped.
+		if !ok {
+			result.Filtered++
+			return
+		}
+	}
+	key := p.Measurement
+
+	// batches of backends are all in nanoseconds.
+	normalized, err := ic.NormalizeTime(p, params.Precision, now)
 	if err != nil {
-		log.Printf("scan key error: %s\n", err)
 		atomic.AddInt64(&ic.stats.PointsWrittenFail, 1)
+		result.reject(line, err)
 		return
 	}
+	if changed || normalized {
+		line = p.Bytes()
+	}
+	params.Precision = ""
+	if result.forward != nil {
+		result.forward.Write(line)
+		result.forward.WriteByte('\n')
+	}
 
-	bs, ok := ic.GetBackends(key)
+	router := ic.getRouter()
+	var tags map[string]string
+	if router.HasTagRoutes(params.DB, key) {
+		tags = make(map[string]string, len(p.Tags))
+		for _, tag := range p.Tags {
+			tags[tag.Key] = tag.Value
+		}
+	}
+
+	route, ok := router.MatchSeries(params.DB, key, tags)
+	if ic.autoregister && (!ok || router.IsFallback(params.DB, route)) {
+		ic.noteUnrouted(router, params.DB, key)
+	}
 	if !ok {
 		log.Printf("new measurement: %s\n", key)
 		atomic.AddInt64(&ic.stats.PointsWrittenFail, 1)
-		// TODO: new measurement?
+		result.unroute(key)
 		return
 	}
 
+	bs := route.Backends()
+	if route.Sharded() {
+		var series string
+		series, err = ScanSeries(line)
+		if err != nil {
+			log.Printf("scan series error: %s\n", err)
+			atomic.AddInt64(&ic.stats.PointsWrittenFail, 1)
+			result.Failed++
+			return
+		}
+		bs = route.SeriesBackends(series)
+	}
+
 	// don't block here for a lont time, we just have one worker.
+	// a backend failed doesn't stop others having the point.
+	failed := false
 	for _, b := range bs {
-		err = b.Write(line)
+		err = b.Write(line, params)
 		if err != nil {
 			log.Printf("cluster write fail: %s\n", key)
-			atomic.AddInt64(&ic.stats.PointsWrittenFail, 1)
-			return
+			failed = true
+			continue
 		}
+		result.enqueue(b)
 	}
-	return
+	if failed {
+		atomic.AddInt64(&ic.stats.PointsWrittenFail, 1)
+		result.Failed++
+		return
+	}
+	result.Accepted++
 }
 
-func (ic *InfluxCluster) Write(p []byte) (err error) {
+// Write writes lines in p, lines failed don't stop others. result
+// accounts every line, err is only for a failure of the whole request.
+func (ic *InfluxCluster) Write(p []byte, params WriteParams) (result *WriteResult, err error) {
 	atomic.AddInt64(&ic.stats.WriteRequests, 1)
 	defer func(start time.Time) {
 		atomic.AddInt64(&ic.stats.WriteRequestDuration, time.Since(start).Nanoseconds())
 	}(time.Now())
 
 	buf := bytes.NewBuffer(p)
+	now := time.Now()
+	result = NewWriteResult()
+	ic.lock.RLock()
+	if len(ic.bas) > 0 {
+		result.forward = &bytes.Buffer{}
+	}
+	ic.lock.RUnlock()
 
 	var line []byte
 	for {
@@ -499,14 +1190,17 @@ func (ic *InfluxCluster) Write(p []byte) (err error) {
 			break
 		}
 
-		ic.WriteRow(line)
+		ic.WriteRow(line, params, now, result)
 	}
 
 	ic.lock.RLock()
 	defer ic.lock.RUnlock()
-	if len(ic.bas) > 0 {
+	result.name(ic.backends)
+	// nexts get points as sent to backends, in nanoseconds.
+	if len(ic.bas) > 0 && result.forward != nil && result.forward.Len() > 0 {
+		params.Precision = ""
 		for _, n := range ic.bas {
-			err = n.Write(p)
+			err = n.Write(result.forward.Bytes(), params)
 			if err != nil {
 				log.Printf("error: %s\n", err)
 				atomic.AddInt64(&ic.stats.WriteRequestsFail, 1)
@@ -6,10 +6,19 @@ package backend
 
 import (
 	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -76,6 +85,69 @@ func BenchmarkScanKey(b *testing.B) {
 	}
 }
 
+func TestParseWriteParams(t *testing.T) {
+	params, err := ParseWriteParams(url.Values{"db": {"test"}, "precision": {"ms"}, "rp": {"week"}, "consistency": {"one"}})
+	want := WriteParams{DB: "test", Precision: "ms", RP: "week", Consistency: "one"}
+	if err != nil || params != want {
+		t.Errorf("params wrong: %+v %v", params, err)
+	}
+	if q := params.Values().Encode(); q != "consistency=one&precision=ms&rp=week" {
+		t.Errorf("values wrong: %s", q)
+	}
+
+	if _, err = ParseWriteParams(url.Values{"precision": {"d"}}); err != ErrIllegalPrecision {
+		t.Errorf("illegal precision passed: %v", err)
+	}
+	if _, err = ParseWriteParams(url.Values{"consistency": {"some"}}); err != ErrIllegalConsistency {
+		t.Errorf("illegal consistency passed: %v", err)
+	}
+}
+
+func TestNormalizeTime(t *testing.T) {
+	ic := NewInfluxCluster(&StaticConfigSource{}, &NodeConfig{FutureLimit: time.Hour})
+	defer ic.Close()
+	now := time.Unix(1500000000, 0)
+
+	tests := []struct {
+		line      string
+		precision string
+		out       string
+		err       error
+	}{
+		{line: "cpu value=1 1500000000000000000", out: "cpu value=1 1500000000000000000"},
+		{line: "cpu value=1 1500000000", precision: "s", out: "cpu value=1 1500000000000000000"},
+		{line: "cpu value=1 1500000000000", precision: "ms", out: "cpu value=1 1500000000000000000"},
+		{line: "cpu value=1 25000000", precision: "m", out: "cpu value=1 1500000000000000000"},
+		{line: `cpu msg="a b"`, precision: "s", out: `cpu msg="a b" 1500000000000000000`},
+		// a quote in field key is not a string.
+		{line: `cpu a"b=1 1500000000`, precision: "s", out: `cpu a"b=1 1500000000000000000`},
+		{line: "cpu value=1 1500003601", precision: "s", err: ErrFutureTimestamp},
+		{line: "cpu value=1 9223372036854775807", precision: "s", err: ErrIllegalTimestamp},
+	}
+	for _, tt := range tests {
+		p, err := ParsePoint([]byte(tt.line))
+		if err != nil {
+			t.Fatalf("%s: error: %s", tt.line, err)
+		}
+		_, err = ic.NormalizeTime(p, tt.precision, now)
+		if err != tt.err || (err == nil && string(p.Bytes()) != tt.out) {
+			t.Errorf("%s: normalized wrong: %s %v", tt.line, p.Bytes(), err)
+		}
+	}
+
+	p, _ := ParsePoint([]byte("cpu value=1 1500000000000000000"))
+	if changed, err := ic.NormalizeTime(p, "", now); changed || err != nil {
+		t.Errorf("nanoseconds changed: %v %v", changed, err)
+	}
+
+	ic.future_clamp = true
+	p, _ = ParsePoint([]byte("cpu value=1 1500007200"))
+	_, err := ic.NormalizeTime(p, "s", now)
+	if err != nil || string(p.Bytes()) != "cpu value=1 1500003600000000000" {
+		t.Errorf("not clamped: %s %v", p.Bytes(), err)
+	}
+}
+
 func CreateTestInfluxCluster() (ic *InfluxCluster, err error) {
 	redisConfig := &RedisConfigSource{}
 	nodeConfig := &NodeConfig{}
@@ -87,7 +159,7 @@ func CreateTestInfluxCluster() (ic *InfluxCluster, err error) {
 	cfg, _ = CreateTestBackendConfig("test2")
 	bkcfgs["test2"] = cfg
 	cfg, _ = CreateTestBackendConfig("write_only")
-	cfg.WriteOnly = 1
+	cfg.WriteOnly = true
 	bkcfgs["write_only"] = cfg
 	for name, cfg := range bkcfgs {
 		backends[name], err = NewBackends(cfg, name)
@@ -96,12 +168,12 @@ func CreateTestInfluxCluster() (ic *InfluxCluster, err error) {
 		}
 	}
 	ic.backends = backends
-	ic.nexts = "test2"
+	ic.nexts = []string{"test2"}
 	ic.bas = append(ic.bas, backends["test2"])
-	m2bs := make(map[string][]BackendAPI)
-	m2bs["cpu"] = append(m2bs["cpu"], backends["write_only"], backends["test1"])
-	m2bs["write_only"] = append(m2bs["write_only"], backends["write_only"])
-	ic.m2bs = m2bs
+	router := NewRouter()
+	router.Add("cpu", NewRoute([]BackendAPI{backends["write_only"], backends["test1"]}))
+	router.Add("write_only", NewRoute([]BackendAPI{backends["write_only"]}))
+	ic.router = router
 
 	return
 }
@@ -138,7 +210,7 @@ func TestInfluxdbClusterWrite(t *testing.T) {
 		},
 	}
 	for _, tt := range tests {
-		err := ic.Write(tt.args)
+		_, err := ic.Write(tt.args, WriteParams{})
 		if err != nil {
 			t.Error(tt.name, err)
 			continue
@@ -247,3 +319,393 @@ func TestInfluxdbClusterQuery(t *testing.T) {
 		}
 	}
 }
+
+type StaticConfigSource struct {
+	nodecfg      NodeConfig
+	backends     map[string]*BackendConfig
+	measurements map[string][]string
+}
+
+func (scs *StaticConfigSource) LoadNode() (nodecfg NodeConfig, err error) {
+	return scs.nodecfg, nil
+}
+
+func (scs *StaticConfigSource) LoadBackends() (backends map[string]*BackendConfig, err error) {
+	backends = make(map[string]*BackendConfig, len(scs.backends))
+	for name, cfg := range scs.backends {
+		c := *cfg
+		backends[name] = &c
+	}
+	return
+}
+
+func (scs *StaticConfigSource) LoadMeasurements() (m_map map[string][]string, err error) {
+	return scs.measurements, nil
+}
+
+func TestInfluxClusterReload(t *testing.T) {
+	cfg1, ts1 := CreateTestBackendConfig("reload1")
+	defer ts1.Close()
+	cfg2, ts2 := CreateTestBackendConfig("reload2")
+	defer ts2.Close()
+	cfg3, ts3 := CreateTestBackendConfig("reload3")
+	defer ts3.Close()
+
+	scs := &StaticConfigSource{
+		backends: map[string]*BackendConfig{"reload1": cfg1, "reload2": cfg2},
+		measurements: map[string][]string{
+			"cpu": []string{"reload1", "reload2"},
+		},
+	}
+	ic := NewInfluxCluster(scs, &scs.nodecfg)
+	defer ic.Close()
+
+	err := ic.LoadConfig()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	orig := ic.backends
+
+	// reload1 unchanged, reload2 changed, reload3 added.
+	cfg2.MaxRowLimit = 1
+	scs.backends["reload3"] = cfg3
+	err = ic.LoadConfig()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	if ic.backends["reload1"] != orig["reload1"] {
+		t.Errorf("unchanged backend recreated")
+	}
+	if ic.backends["reload2"] == orig["reload2"] {
+		t.Errorf("changed backend not recreated")
+	}
+	if ic.backends["reload3"] == nil {
+		t.Errorf("new backend not created")
+	}
+
+	// old one hands over writes to the new one.
+	old := orig["reload2"].(*Backends)
+	if old.next != ic.backends["reload2"] {
+		t.Errorf("changed backend not handed over")
+	}
+	err = old.Write([]byte("cpu value=1 1434055562000000000"), WriteParams{})
+	if err != nil {
+		t.Errorf("write to renewed backend failed: %s", err)
+	}
+
+	// dangling reference is skipped, others still route.
+	scs.measurements["mem"] = []string{"reload1", "unknown"}
+	ic.nexts = []string{"unknown"}
+	delete(scs.backends, "reload3")
+	err = ic.LoadConfig()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if route, ok := ic.router.Match("mem"); !ok || len(route.Backends()) != 1 {
+		t.Errorf("dangling reference not skipped")
+	}
+	if len(ic.bas) != 0 {
+		t.Errorf("dangling next not skipped")
+	}
+	if _, ok := ic.backends["reload3"]; ok {
+		t.Errorf("removed backend still exists")
+	}
+
+	// no backend left, no route, points are unrouted.
+	scs.measurements["disk"] = []string{"gone"}
+	err = ic.LoadConfig()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if _, ok := ic.router.Match("disk"); ok {
+		t.Errorf("route without backends")
+	}
+	result, err := ic.Write([]byte("disk value=1\n"), WriteParams{})
+	if err != nil || result.Accepted != 0 || result.DroppedUnrouted != 1 {
+		t.Errorf("write without backends wrong: %+v %v", result, err)
+	}
+	if _, ok := result.Err().(*PartialWriteError); !ok {
+		t.Errorf("write without backends not failed: %v", result.Err())
+	}
+	time.Sleep(time.Second)
+}
+
+type VersionedStaticConfigSource struct {
+	StaticConfigSource
+	version   int64
+	snapshots map[int64]map[string][]string
+}
+
+func (vcs *VersionedStaticConfigSource) Version() (version int64, err error) {
+	return vcs.version, nil
+}
+
+func (vcs *VersionedStaticConfigSource) Rollback(version int64) (err error) {
+	m_map, ok := vcs.snapshots[version]
+	if !ok {
+		return ErrVersionNotExist
+	}
+	vcs.measurements = m_map
+	vcs.version = version
+	return
+}
+
+func TestInfluxClusterRollback(t *testing.T) {
+	cfg, ts := CreateTestBackendConfig("rollback")
+	defer ts.Close()
+
+	vcs := &VersionedStaticConfigSource{
+		StaticConfigSource: StaticConfigSource{
+			backends:     map[string]*BackendConfig{"rollback": cfg},
+			measurements: map[string][]string{"cpu": []string{"rollback"}, "mem": []string{"rollback"}},
+		},
+		version: 2,
+		snapshots: map[int64]map[string][]string{
+			1: map[string][]string{"cpu": []string{"rollback"}},
+		},
+	}
+	ic := NewInfluxCluster(vcs, &vcs.nodecfg)
+	defer ic.Close()
+
+	err := ic.LoadConfig()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if ic.Version() != 2 {
+		t.Errorf("version wrong: %d", ic.Version())
+	}
+
+	err = ic.Rollback(3)
+	if err != ErrVersionNotExist || ic.Version() != 2 {
+		t.Errorf("rollback to unknown version: %v", err)
+	}
+
+	err = ic.Rollback(1)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if ic.Version() != 1 {
+		t.Errorf("version wrong after rollback: %d", ic.Version())
+	}
+	if _, ok := ic.GetBackends("mem"); ok {
+		t.Errorf("config not rolled back")
+	}
+
+	ic.cfgsrc = &vcs.StaticConfigSource
+	if ic.Rollback(1) != ErrNotVersioned {
+		t.Errorf("rollback on source not versioned")
+	}
+}
+
+func TestInfluxClusterUpdateConfig(t *testing.T) {
+	_, ts := CreateTestBackendConfig("update")
+	defer ts.Close()
+
+	filename := CreateTestConfigFile(t, "json", fmt.Sprintf(`{
+    "backends": {"update": {"url": "%s", "db": "update"}},
+    "measurements": {"cpu": ["update"]}
+}`, ts.URL))
+	defer os.Remove(filename)
+
+	fcs := NewFileConfigSource(filename, "l1")
+	ic := NewInfluxCluster(fcs, &NodeConfig{})
+	defer ic.Close()
+
+	err := ic.LoadConfig()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	_, err = ic.UpdateConfig(func(raw *RawConfig) error {
+		raw.Measurements["mem"] = []string{"update"}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if _, ok := ic.GetBackends("mem"); !ok {
+		t.Errorf("update not loaded")
+	}
+	raw, err := fcs.LoadRaw()
+	if err != nil || len(raw.Measurements["mem"]) != 1 {
+		t.Errorf("update not saved: %v %v", raw, err)
+	}
+
+	report, err := ic.UpdateConfig(func(raw *RawConfig) error {
+		delete(raw.Backends, "update")
+		return nil
+	})
+	if err != ErrIllegalConfig || !hasIssue(report.Errors, "m:cpu", "") {
+		t.Errorf("invalid update passed: %v %+v", err, report)
+	}
+	raw, err = fcs.LoadRaw()
+	if err != nil || len(raw.Backends) != 1 {
+		t.Errorf("invalid update saved: %v %v", raw, err)
+	}
+
+	ic.cfgsrc = &StaticConfigSource{}
+	if _, err = ic.UpdateConfig(func(raw *RawConfig) error { return nil }); err != ErrNotWritable {
+		t.Errorf("update on source not writable: %v", err)
+	}
+}
+
+func TestInfluxClusterUnrouted(t *testing.T) {
+	_, ts := CreateTestBackendConfig("unrouted")
+	defer ts.Close()
+
+	filename := CreateTestConfigFile(t, "json", fmt.Sprintf(`{
+    "backends": {"unrouted": {"url": "%s", "db": "unrouted"}},
+    "measurements": {"cpu": ["unrouted"], "*": ["unrouted"]}
+}`, ts.URL))
+	defer os.Remove(filename)
+	defer os.Remove(filename + ".unrouted")
+
+	fcs := NewFileConfigSource(filename, "l1")
+	ic := NewInfluxCluster(fcs, &NodeConfig{AutoRegister: true})
+	defer ic.Close()
+
+	err := ic.LoadConfig()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	result, err := ic.Write([]byte("cpu value=1\nmem value=1\ndisk value=1\n"), WriteParams{})
+	if err != nil || result.Err() != nil {
+		t.Fatalf("error: %v %v", err, result.Err())
+	}
+	if ic.stats.PointsWrittenFail != 0 {
+		t.Errorf("points to catch-all route failed")
+	}
+	ic.recordUnrouted()
+	names, err := fcs.LoadUnrouted()
+	if err != nil || !reflect.DeepEqual(names, []string{"disk", "mem"}) {
+		t.Errorf("unrouted not recorded: %v %v", names, err)
+	}
+
+	_, err = ic.UpdateConfig(func(raw *RawConfig) error {
+		raw.Measurements["mem"] = []string{"unrouted"}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	names, err = ic.Unrouted()
+	if err != nil || !reflect.DeepEqual(names, []string{"disk"}) {
+		t.Errorf("pinned measurement not dropped: %v %v", names, err)
+	}
+
+	err = ic.DismissUnrouted("disk")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	names, err = fcs.LoadUnrouted()
+	if err != nil || len(names) != 0 {
+		t.Errorf("unrouted not dismissed: %v %v", names, err)
+	}
+}
+
+func TestInfluxClusterWriteResult(t *testing.T) {
+	var writes int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			atomic.AddInt32(&writes, 1)
+		}
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	cfg, _ := CreateTestBackendConfig("result")
+	cfg.URL = ts.URL
+	hb := NewHttpBackend(cfg)
+	defer hb.Close()
+	closed, err := NewBackends(cfg, "closed")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	closed.Close()
+
+	ic := NewInfluxCluster(&StaticConfigSource{}, &NodeConfig{})
+	defer ic.Close()
+	ic.backends = map[string]BackendAPI{"result": hb}
+	ic.router.Add("cpu", NewRoute([]BackendAPI{hb}))
+	ic.router.Add("disk", NewRoute([]BackendAPI{hb, closed}))
+
+	result, err := ic.Write([]byte("cpu value=1\ncpu value=abc\ncpu,host=a value=2i 1000\ncpu value=1 12ab\nmem value=1\nmem value=2\n"), WriteParams{})
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if result.Accepted != 2 || result.DroppedInvalid != 2 || result.DroppedUnrouted != 2 ||
+		!reflect.DeepEqual(result.Enqueued, map[string]int{"result": 2}) {
+		t.Errorf("result wrong: %+v", result)
+	}
+	err = result.Err()
+	partial, ok := err.(*PartialWriteError)
+	if !ok {
+		t.Fatalf("not a partial write: %v", err)
+	}
+	want := "partial write: unable to parse 'cpu value=abc': invalid boolean\n" +
+		"unable to parse 'cpu value=1 12ab': bad timestamp\n" +
+		"measurement 'mem' has no route dropped=4"
+	if partial.Dropped != 4 || err.Error() != want {
+		t.Errorf("partial write wrong: %s", err)
+	}
+	if n := atomic.LoadInt32(&writes); n != 2 {
+		t.Errorf("%d lines written", n)
+	}
+
+	result, err = ic.Write([]byte("cpu value=1\n"), WriteParams{})
+	if err != nil || result.Err() != nil || result.Accepted != 1 {
+		t.Errorf("write wrong: %+v %v", result, err)
+	}
+
+	result, err = ic.Write([]byte("disk value=1\nmem value=1\n"), WriteParams{})
+	if err != nil || result.Err() != ErrWriteFailed || result.Failed != 1 || result.Enqueued["result"] != 1 {
+		t.Errorf("failed write wrong: %+v %v", result, err)
+	}
+}
+
+func TestInfluxClusterForwardNexts(t *testing.T) {
+	var lock sync.Mutex
+	var query, body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			zip, _ := gzip.NewReader(req.Body)
+			p, _ := ioutil.ReadAll(zip)
+			lock.Lock()
+			query, body = req.URL.RawQuery, string(p)
+			lock.Unlock()
+		}
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	cfg, _ := CreateTestBackendConfig("next")
+	cfg.URL = ts.URL
+	hb := NewHttpBackend(cfg)
+	defer hb.Close()
+
+	ic := NewInfluxCluster(&StaticConfigSource{}, &NodeConfig{})
+	defer ic.Close()
+	ic.bas = []BackendAPI{hb}
+
+	now := time.Now()
+	_, err := ic.Write([]byte("cpu value=1\ncpu value=abc\nmem value=2 5\n"), WriteParams{Precision: "s"})
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if query != "db=next" {
+		t.Errorf("query wrong: %s", query)
+	}
+	lines := strings.Split(body, "\n")
+	if len(lines) != 3 || lines[1] != "mem value=2 5000000000" || lines[2] != "" {
+		t.Fatalf("body wrong: %q", body)
+	}
+	ts0, err := strconv.ParseInt(strings.TrimPrefix(lines[0], "cpu value=1 "), 10, 64)
+	if err != nil || ts0 < now.UnixNano() || ts0 > time.Now().UnixNano() {
+		t.Errorf("point not stamped at receipt: %s", lines[0])
+	}
+}
@@ -5,77 +5,344 @@
 package backend
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"gopkg.in/redis.v5"
 )
 
 const (
 	VERSION = "1.1"
+	// publish anything here to make every node reload.
+	RELOAD_CHANNEL = "influx-proxy:reload"
+	// tries of an apply raced by another one.
+	APPLY_RETRIES = 3
 )
 
 var (
-	ErrIllegalConfig = errors.New("illegal config")
+	ErrIllegalConfig   = errors.New("illegal config")
+	ErrNotWatchable    = errors.New("config source can't be watched")
+	ErrNotVersioned    = errors.New("config source not versioned")
+	ErrVersionNotExist = errors.New("config version not exists")
+	ErrNotWritable     = errors.New("config source not writable")
 )
 
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// ConfigKey is the key of a struct field in config, its config tag or
+// lowercased name.
+func ConfigKey(field reflect.StructField) (key string) {
+	key = field.Tag.Get("config")
+	if key == "" {
+		key = strings.ToLower(field.Name)
+	}
+	return
+}
+
+// SplitList splits a comma separated list, spaces and empty items dropped.
+func SplitList(s string) (l []string) {
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			l = append(l, item)
+		}
+	}
+	return
+}
+
+// duration like "10s", or a bare number in unit, for numbers in old config.
+func parseDuration(s string, unit string) (d time.Duration, err error) {
+	if unit == "" {
+		unit = "ms"
+	}
+	if _, err = strconv.ParseFloat(s, 64); err == nil {
+		s += unit
+	}
+	return time.ParseDuration(s)
+}
+
+func setField(valueField reflect.Value, typeField reflect.StructField, s string) (err error) {
+	if typeField.Type == durationType {
+		var d time.Duration
+		d, err = parseDuration(s, typeField.Tag.Get("unit"))
+		if err != nil {
+			return
+		}
+		valueField.SetInt(int64(d))
+		return
+	}
+
+	switch typeField.Type.Kind() {
+	case reflect.String:
+		valueField.SetString(s)
+	case reflect.Int:
+		var x int
+		x, err = strconv.Atoi(s)
+		if err != nil {
+			return
+		}
+		valueField.SetInt(int64(x))
+	case reflect.Bool:
+		var b bool
+		b, err = strconv.ParseBool(s)
+		if err != nil {
+			return
+		}
+		valueField.SetBool(b)
+	case reflect.Float64:
+		var f float64
+		f, err = strconv.ParseFloat(s, 64)
+		if err != nil {
+			return
+		}
+		valueField.SetFloat(f)
+	case reflect.Slice:
+		if typeField.Type.Elem().Kind() != reflect.String {
+			return ErrIllegalConfig
+		}
+		valueField.Set(reflect.ValueOf(SplitList(s)))
+	default:
+		return ErrIllegalConfig
+	}
+	return
+}
+
+// a duration with a default, like an interval or a timeout, not positive
+// is taken as unset. zero of it means no timeout or a busy loop.
+func unsetDuration(typeField reflect.StructField, s string) bool {
+	if typeField.Type != durationType || typeField.Tag.Get("default") == "" {
+		return false
+	}
+	d, err := parseDuration(s, typeField.Tag.Get("unit"))
+	return err == nil && d <= 0
+}
+
+// LoadStructFromMap sets fields of o which have a key in data. Supports
+// string, int, bool, float64, time.Duration and []string split by ','.
+// A duration can be a bare number in unit of its unit tag, ms by default.
 func LoadStructFromMap(data map[string]string, o interface{}) (err error) {
-	var x int
 	val := reflect.ValueOf(o).Elem()
 	for i := 0; i < val.NumField(); i++ {
-		valueField := val.Field(i)
 		typeField := val.Type().Field(i)
-
-		name := strings.ToLower(typeField.Name)
+		name := ConfigKey(typeField)
 		s, ok := data[name]
 		if !ok {
 			continue
 		}
+		if unsetDuration(typeField, s) {
+			log.Printf("%s is %s, not positive, ignored", name, s)
+			continue
+		}
 
-		switch typeField.Type.Kind() {
-		case reflect.String:
-			valueField.SetString(s)
-		case reflect.Int:
-			x, err = strconv.Atoi(s)
-			if err != nil {
-				log.Printf("%s: %s", err, name)
-				return
-			}
-			valueField.SetInt(int64(x))
+		err = setField(val.Field(i), typeField, s)
+		if err != nil {
+			log.Printf("%s: %s", err, name)
+			return
 		}
 	}
 	return
 }
 
+// SetDefaults sets fields of o by their default tag.
+func SetDefaults(o interface{}) (err error) {
+	val := reflect.ValueOf(o).Elem()
+	for i := 0; i < val.NumField(); i++ {
+		typeField := val.Type().Field(i)
+		s, ok := typeField.Tag.Lookup("default")
+		if !ok {
+			continue
+		}
+
+		err = setField(val.Field(i), typeField, s)
+		if err != nil {
+			log.Printf("%s: default of %s", err, typeField.Name)
+			return
+		}
+	}
+	return
+}
+
+// ConfigSource is where the cluster gets its node, backend and measurement
+// definitions from.
+type ConfigSource interface {
+	LoadNode() (nodecfg NodeConfig, err error)
+	LoadBackends() (backends map[string]*BackendConfig, err error)
+	LoadMeasurements() (m_map map[string][]string, err error)
+}
+
+// RawConfig is the whole config as stored, before decoded.
+type RawConfig struct {
+	DefaultNode  map[string]string            `json:"default_node" yaml:"default_node" toml:"default_node"`
+	Nodes        map[string]map[string]string `json:"nodes" yaml:"nodes" toml:"nodes"`
+	Backends     map[string]map[string]string `json:"backends" yaml:"backends" toml:"backends"`
+	Measurements map[string][]string          `json:"measurements" yaml:"measurements" toml:"measurements"`
+	Rewrites     map[string]map[string]string `json:"rewrites" yaml:"rewrites" toml:"rewrites"`
+	Filters      map[string]map[string]string `json:"filters" yaml:"filters" toml:"filters"`
+}
+
+func NewRawConfig() (raw *RawConfig) {
+	return &RawConfig{
+		DefaultNode:  make(map[string]string),
+		Nodes:        make(map[string]map[string]string),
+		Backends:     make(map[string]map[string]string),
+		Measurements: make(map[string][]string),
+		Rewrites:     make(map[string]map[string]string),
+		Filters:      make(map[string]map[string]string),
+	}
+}
+
+func (raw *RawConfig) NodeConfig(node string) (nodecfg NodeConfig, err error) {
+	nodecfg, err = LoadNodeConfig(raw.DefaultNode, raw.Nodes[node])
+	if err != nil {
+		log.Printf("load error: n:%s", node)
+	}
+	return
+}
+
+func (raw *RawConfig) BackendConfigs() (backends map[string]*BackendConfig, err error) {
+	backends = make(map[string]*BackendConfig)
+	for name, val := range raw.Backends {
+		backends[name], err = LoadBackendConfig(val)
+		if err != nil {
+			log.Printf("load error: b:%s", name)
+			return
+		}
+	}
+	return
+}
+
+func (raw *RawConfig) RewriteConfigs() (rewrites map[string]*RewriteConfig, err error) {
+	rewrites = make(map[string]*RewriteConfig)
+	for name, val := range raw.Rewrites {
+		rewrites[name], err = LoadRewriteConfig(val)
+		if err != nil {
+			log.Printf("load error: r:%s", name)
+			return
+		}
+	}
+	return
+}
+
+func (raw *RawConfig) FilterConfigs() (filters map[string]*FilterConfig, err error) {
+	filters = make(map[string]*FilterConfig)
+	for name, val := range raw.Filters {
+		filters[name], err = LoadFilterConfig(val)
+		if err != nil {
+			log.Printf("load error: f:%s", name)
+			return
+		}
+	}
+	return
+}
+
+// RewriteSource is a ConfigSource which has rewrite rules.
+type RewriteSource interface {
+	LoadRewrites() (rewrites map[string]*RewriteConfig, err error)
+}
+
+// FilterSource is a ConfigSource which has filter rules.
+type FilterSource interface {
+	LoadFilters() (filters map[string]*FilterConfig, err error)
+}
+
+// RawConfigSource is a ConfigSource which can give the whole raw config,
+// for validation and export.
+type RawConfigSource interface {
+	LoadRaw() (raw *RawConfig, err error)
+}
+
+// RefreshableConfigSource is a ConfigSource which caches a remote config,
+// Refresh is called once on every reload to get it again.
+type RefreshableConfigSource interface {
+	Refresh() (err error)
+}
+
+// WritableConfigSource is a ConfigSource can be changed through the
+// proxy, by the admin api.
+type WritableConfigSource interface {
+	RawConfigSource
+	SaveRaw(raw *RawConfig) (err error)
+}
+
+// UnroutedRecorder is a ConfigSource which keeps names of measurements
+// written without a route, for operators to review and pin them.
+type UnroutedRecorder interface {
+	RecordUnrouted(names []string) (err error)
+	LoadUnrouted() (names []string, err error)
+	RemoveUnrouted(names []string) (err error)
+}
+
+// VersionedConfigSource is a ConfigSource keeps every applied config as
+// a numbered snapshot.
+type VersionedConfigSource interface {
+	Version() (version int64, err error)
+	Rollback(version int64) (err error)
+}
+
+// ConfigWatcher is a ConfigSource which knows when its config changed.
+// Watch should return after setup and call notify on every change.
+type ConfigWatcher interface {
+	Watch(notify func()) (err error)
+}
+
+// Debounce merges calls in delay into one call of fn, made delay after
+// the last of them.
+func Debounce(delay time.Duration, fn func()) func() {
+	var lock sync.Mutex
+	var timer *time.Timer
+	return func() {
+		lock.Lock()
+		defer lock.Unlock()
+		if timer != nil {
+			timer.Stop()
+		}
+		timer = time.AfterFunc(delay, fn)
+	}
+}
+
 type NodeConfig struct {
-	ListenAddr   string
-	DB           string
-	Zone         string
-	Nexts        string
-	Interval     int
-	IdleTimeout  int
-	WriteTracing int
-	QueryTracing int
+	ListenAddr   string        `config:"listenaddr"`
+	DB           string        `config:"db"`
+	Zone         string        `config:"zone"`
+	Nexts        []string      `config:"nexts"`
+	Interval     time.Duration `config:"interval" unit:"s" default:"10s"`
+	IdleTimeout  time.Duration `config:"idletimeout" unit:"s" default:"10s"`
+	WriteTracing bool          `config:"writetracing"`
+	QueryTracing bool          `config:"querytracing"`
+	AutoRegister bool          `config:"autoregister"`
+	FutureLimit  time.Duration `config:"futurelimit" unit:"s"`
+	FutureAction string        `config:"futureaction" default:"reject"`
 }
 
 type BackendConfig struct {
-	URL             string
-	DB              string
-	Zone            string
-	Interval        int
-	Timeout         int
-	TimeoutQuery    int
-	MaxRowLimit     int
-	CheckInterval   int
-	RewriteInterval int
-	WriteOnly       int
+	URL             string        `config:"url"`
+	DB              string        `config:"db"`
+	Zone            string        `config:"zone"`
+	Interval        time.Duration `config:"interval" default:"1s"`
+	Timeout         time.Duration `config:"timeout" default:"10s"`
+	TimeoutQuery    time.Duration `config:"timeoutquery" default:"10m"`
+	MaxRowLimit     int           `config:"maxrowlimit" default:"10000"`
+	CheckInterval   time.Duration `config:"checkinterval" default:"1s"`
+	RewriteInterval time.Duration `config:"rewriteinterval" default:"10s"`
+	WriteOnly       bool          `config:"writeonly"`
+	// create db when a write finds it not exists, with a default
+	// retention policy if name given, duration 0 for infinite.
+	AutoCreate         bool          `config:"autocreate"`
+	AutoCreateRP       string        `config:"autocreaterp"`
+	AutoCreateDuration time.Duration `config:"autocreateduration"`
 }
 
 type RedisConfigSource struct {
 	client *redis.Client
+	db     int
 	node   string
 	zone   string
 }
@@ -83,31 +350,107 @@ type RedisConfigSource struct {
 func NewRedisConfigSource(options *redis.Options, node string) (rcs *RedisConfigSource) {
 	rcs = &RedisConfigSource{
 		client: redis.NewClient(options),
+		db:     options.DB,
 		node:   node,
 	}
 	return
 }
 
-func (rcs *RedisConfigSource) LoadNode() (nodecfg NodeConfig, err error) {
-	val, err := rcs.client.HGetAll("default_node").Result()
+// add flags to notify-keyspace-events, keep what others need.
+func mergeEventFlags(orig string, flags string) (merged string) {
+	merged = orig
+	for _, c := range flags {
+		if strings.ContainsRune(merged, c) {
+			continue
+		}
+		// A is alias for g$lshzxe
+		if strings.ContainsRune(merged, 'A') && strings.ContainsRune("g$lshzxe", c) {
+			continue
+		}
+		merged += string(c)
+	}
+	return
+}
+
+func (rcs *RedisConfigSource) enableKeyspaceEvents() (err error) {
+	val, err := rcs.client.ConfigGet("notify-keyspace-events").Result()
 	if err != nil {
-		log.Printf("redis load error: b:%s", rcs.node)
 		return
 	}
 
-	err = LoadStructFromMap(val, &nodecfg)
+	var orig string
+	if len(val) == 2 {
+		orig = fmt.Sprint(val[1])
+	}
+	// keyspace events for generic, string, hash and list commands.
+	merged := mergeEventFlags(orig, "Kg$hl")
+	if merged == orig {
+		return
+	}
+	return rcs.client.ConfigSet("notify-keyspace-events", merged).Err()
+}
+
+// Watch subscribes to keyspace notifications of the config keys and to
+// RELOAD_CHANNEL. notify is called for every single event, so debounce it.
+func (rcs *RedisConfigSource) Watch(notify func()) (err error) {
+	// maybe not allowed to config, then only reload channel works.
+	err = rcs.enableKeyspaceEvents()
+	if err != nil {
+		log.Printf("enable keyspace events error: %s", err)
+	}
+
+	prefix := fmt.Sprintf("__keyspace@%d__:", rcs.db)
+	pubsub, err := rcs.client.PSubscribe(
+		prefix+"b:*", prefix+"m:*", prefix+"n:*", prefix+"r:*", prefix+"f:*",
+		prefix+"default_node",
+		prefix+"config_version", RELOAD_CHANNEL)
+	if err != nil {
+		log.Printf("redis subscribe error: %s", err)
+		return
+	}
+
+	go func() {
+		for {
+			msg, err := pubsub.ReceiveMessage()
+			if err != nil {
+				log.Printf("redis receive error: %s", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			log.Printf("config changed: %s %s", msg.Channel, msg.Payload)
+			notify()
+		}
+	}()
+	return
+}
+
+func (rcs *RedisConfigSource) LoadNodeLayers() (layers []ConfigLayer, err error) {
+	defaultval, err := rcs.client.HGetAll("default_node").Result()
 	if err != nil {
 		log.Printf("redis load error: b:%s", rcs.node)
 		return
 	}
 
-	val, err = rcs.client.HGetAll("n:" + rcs.node).Result()
+	val, err := rcs.client.HGetAll("n:" + rcs.node).Result()
 	if err != nil {
 		log.Printf("redis load error: b:%s", rcs.node)
 		return
 	}
 
-	err = LoadStructFromMap(val, &nodecfg)
+	layers = []ConfigLayer{
+		{Name: "default_node", Data: defaultval},
+		{Name: "n:" + rcs.node, Data: val},
+	}
+	return
+}
+
+func (rcs *RedisConfigSource) LoadNode() (nodecfg NodeConfig, err error) {
+	layers, err := rcs.LoadNodeLayers()
+	if err != nil {
+		return
+	}
+
+	nodecfg, _, err = LoadNodeConfigLayers(layers...)
 	if err != nil {
 		log.Printf("redis load error: b:%s", rcs.node)
 		return
@@ -146,29 +489,297 @@ func (rcs *RedisConfigSource) LoadConfigFromRedis(name string) (cfg *BackendConf
 		return
 	}
 
+	return LoadBackendConfig(val)
+}
+
+// LoadBackendConfig decodes a backend definition, with defaults.
+func LoadBackendConfig(data map[string]string) (cfg *BackendConfig, err error) {
 	cfg = &BackendConfig{}
-	err = LoadStructFromMap(val, cfg)
+	err = SetDefaults(cfg)
+	if err != nil {
+		return
+	}
+	err = LoadStructFromMap(data, cfg)
+	return
+}
+
+// LoadNodeConfig decodes node definitions, later ones override earlier.
+func LoadNodeConfig(datas ...map[string]string) (nodecfg NodeConfig, err error) {
+	err = SetDefaults(&nodecfg)
+	if err != nil {
+		return
+	}
+	for _, data := range datas {
+		err = LoadStructFromMap(data, &nodecfg)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (rcs *RedisConfigSource) LoadRaw() (raw *RawConfig, err error) {
+	raw = NewRawConfig()
+
+	raw.DefaultNode, err = rcs.client.HGetAll("default_node").Result()
+	if err != nil {
+		log.Printf("read redis error: %s", err)
+		return
+	}
+
+	for prefix, hashes := range map[string]*map[string]map[string]string{
+		"n:": &raw.Nodes,
+		"b:": &raw.Backends,
+		"r:": &raw.Rewrites,
+		"f:": &raw.Filters,
+	} {
+		*hashes, err = rcs.loadHashes(prefix)
+		if err != nil {
+			return
+		}
+	}
+
+	raw.Measurements, err = rcs.LoadMeasurements()
+	return
+}
+
+// Apply saves raw as a new snapshot and makes it the live config.
+func (rcs *RedisConfigSource) Apply(raw *RawConfig) (version int64, err error) {
+	version, err = rcs.client.Incr("snapshot_seq").Result()
+	if err != nil {
+		log.Printf("write redis error: %s", err)
+		return
+	}
+
+	err = rcs.apply(raw, version, true)
+	return
+}
+
+// SaveRaw applies raw as a new snapshot.
+func (rcs *RedisConfigSource) SaveRaw(raw *RawConfig) (err error) {
+	_, err = rcs.Apply(raw)
+	return
+}
+
+// Version returns version of the live config, 0 if never applied by Apply.
+func (rcs *RedisConfigSource) Version() (version int64, err error) {
+	version, err = rcs.client.Get("config_version").Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return
+}
+
+// Versions lists all snapshots can be rolled back to.
+func (rcs *RedisConfigSource) Versions() (versions []int64, err error) {
+	keys, err := rcs.client.Keys("snapshot:*").Result()
+	if err != nil {
+		return
+	}
+
+	for _, key := range keys {
+		version, err := strconv.ParseInt(key[len("snapshot:"):], 10, 64)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return
+}
+
+// Rollback makes snapshot of version the live config again.
+func (rcs *RedisConfigSource) Rollback(version int64) (err error) {
+	p, err := rcs.client.Get(fmt.Sprintf("snapshot:%d", version)).Result()
+	if err == redis.Nil {
+		return ErrVersionNotExist
+	}
+	if err != nil {
+		log.Printf("read redis error: %s", err)
+		return
+	}
+
+	raw := NewRawConfig()
+	err = json.Unmarshal([]byte(p), raw)
+	if err != nil {
+		log.Printf("snapshot %d broken: %s", version, err)
+		return
+	}
+
+	err = rcs.apply(raw, version, false)
+	return
+}
+
+// replace the whole config in redis by raw in one MULTI/EXEC, so nobody
+// sees a half written config, then tell every node to reload. Keys to
+// delete are read under WATCH of config_version, if another apply made
+// it between, it's tried again.
+func (rcs *RedisConfigSource) apply(raw *RawConfig, version int64, snapshot bool) (err error) {
+	var p []byte
+	if snapshot {
+		p, err = json.Marshal(raw)
+		if err != nil {
+			return
+		}
+	}
+
+	for i := 0; i < APPLY_RETRIES; i++ {
+		err = rcs.client.Watch(func(tx *redis.Tx) error {
+			return rcs.applyTx(tx, raw, version, p)
+		}, "config_version")
+		if err != redis.TxFailedErr {
+			break
+		}
+		log.Printf("config changed while applying version %d, retry.", version)
+	}
+	if err != nil {
+		log.Printf("write redis error: %s", err)
+		return
+	}
+	log.Printf("config version %d applied to redis.", version)
+	return
+}
+
+// snapshot p is saved too if not nil.
+func (rcs *RedisConfigSource) applyTx(tx *redis.Tx, raw *RawConfig, version int64, p []byte) (err error) {
+	var keys []string
+	for _, pattern := range []string{"n:*", "b:*", "m:*", "r:*", "f:*"} {
+		var k []string
+		k, err = tx.Keys(pattern).Result()
+		if err != nil {
+			return
+		}
+		keys = append(keys, k...)
+	}
+
+	_, err = tx.Pipelined(func(pipe *redis.Pipeline) error {
+		if p != nil {
+			pipe.Set(fmt.Sprintf("snapshot:%d", version), p, 0)
+		}
+		pipe.Del(append(keys, "default_node")...)
+		if len(raw.DefaultNode) > 0 {
+			pipe.HMSet("default_node", raw.DefaultNode)
+		}
+		for name, val := range raw.Nodes {
+			if len(val) > 0 {
+				pipe.HMSet("n:"+name, val)
+			}
+		}
+		for name, val := range raw.Backends {
+			if len(val) > 0 {
+				pipe.HMSet("b:"+name, val)
+			}
+		}
+		for name, val := range raw.Rewrites {
+			if len(val) > 0 {
+				pipe.HMSet("r:"+name, val)
+			}
+		}
+		for name, val := range raw.Filters {
+			if len(val) > 0 {
+				pipe.HMSet("f:"+name, val)
+			}
+		}
+		for name, bs_names := range raw.Measurements {
+			if len(bs_names) == 0 {
+				continue
+			}
+			pipe.RPush("m:"+name, stringsToValues(bs_names)...)
+		}
+		pipe.Set("config_version", version, 0)
+		pipe.Publish(RELOAD_CHANNEL, strconv.FormatInt(version, 10))
+		return nil
+	})
+	return
+}
+
+// hashes of keys with prefix, by names without prefix.
+func (rcs *RedisConfigSource) loadHashes(prefix string) (hashes map[string]map[string]string, err error) {
+	hashes = make(map[string]map[string]string)
+
+	keys, err := rcs.client.Keys(prefix + "*").Result()
+	if err != nil {
+		log.Printf("read redis error: %s", err)
+		return
+	}
+
+	for _, key := range keys {
+		hashes[key[len(prefix):]], err = rcs.client.HGetAll(key).Result()
+		if err != nil {
+			log.Printf("redis load error: %s", key)
+			return
+		}
+	}
+	return
+}
+
+func (rcs *RedisConfigSource) LoadRewrites() (rewrites map[string]*RewriteConfig, err error) {
+	raw := NewRawConfig()
+	raw.Rewrites, err = rcs.loadHashes("r:")
 	if err != nil {
 		return
 	}
 
-	if cfg.Interval == 0 {
-		cfg.Interval = 1000
+	rewrites, err = raw.RewriteConfigs()
+	if err != nil {
+		return
 	}
-	if cfg.Timeout == 0 {
-		cfg.Timeout = 10000
+	log.Printf("%d rewrites loaded from redis.", len(rewrites))
+	return
+}
+
+func (rcs *RedisConfigSource) LoadFilters() (filters map[string]*FilterConfig, err error) {
+	raw := NewRawConfig()
+	raw.Filters, err = rcs.loadHashes("f:")
+	if err != nil {
+		return
 	}
-	if cfg.TimeoutQuery == 0 {
-		cfg.TimeoutQuery = 600000
+
+	filters, err = raw.FilterConfigs()
+	if err != nil {
+		return
 	}
-	if cfg.MaxRowLimit == 0 {
-		cfg.MaxRowLimit = 10000
+	log.Printf("%d filters loaded from redis.", len(filters))
+	return
+}
+
+func stringsToValues(l []string) (values []interface{}) {
+	values = make([]interface{}, len(l))
+	for i, s := range l {
+		values[i] = s
 	}
-	if cfg.CheckInterval == 0 {
-		cfg.CheckInterval = 1000
+	return
+}
+
+// RecordUnrouted adds names to set "unrouted", not touched by Apply.
+func (rcs *RedisConfigSource) RecordUnrouted(names []string) (err error) {
+	if len(names) == 0 {
+		return
+	}
+	err = rcs.client.SAdd("unrouted", stringsToValues(names)...).Err()
+	if err != nil {
+		log.Printf("write redis error: %s", err)
+	}
+	return
+}
+
+func (rcs *RedisConfigSource) LoadUnrouted() (names []string, err error) {
+	names, err = rcs.client.SMembers("unrouted").Result()
+	if err != nil {
+		log.Printf("read redis error: %s", err)
+		return
 	}
-	if cfg.RewriteInterval == 0 {
-		cfg.RewriteInterval = 10000
+	sort.Strings(names)
+	return
+}
+
+func (rcs *RedisConfigSource) RemoveUnrouted(names []string) (err error) {
+	if len(names) == 0 {
+		return
+	}
+	err = rcs.client.SRem("unrouted", stringsToValues(names)...).Err()
+	if err != nil {
+		log.Printf("write redis error: %s", err)
 	}
 	return
 }
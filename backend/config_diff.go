@@ -0,0 +1,111 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+func diffHash(key string, a, b map[string]string) (diffs []string) {
+	fields := make(map[string]bool)
+	for f := range a {
+		fields[f] = true
+	}
+	for f := range b {
+		fields[f] = true
+	}
+
+	var names []string
+	for f := range fields {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+
+	for _, f := range names {
+		va, ina := a[f]
+		vb, inb := b[f]
+		switch {
+		case !ina:
+			diffs = append(diffs, fmt.Sprintf("~ %s %s: + %s", key, f, vb))
+		case !inb:
+			diffs = append(diffs, fmt.Sprintf("~ %s %s: - %s", key, f, va))
+		case va != vb:
+			diffs = append(diffs, fmt.Sprintf("~ %s %s: %s -> %s", key, f, va, vb))
+		}
+	}
+	return
+}
+
+func diffHashes(prefix string, a, b map[string]map[string]string) (diffs []string) {
+	names := make(map[string]bool)
+	for name := range a {
+		names[name] = true
+	}
+	for name := range b {
+		names[name] = true
+	}
+
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		va, ina := a[name]
+		vb, inb := b[name]
+		switch {
+		case !ina:
+			diffs = append(diffs, "+ "+prefix+name)
+			diffs = append(diffs, diffHash(prefix+name, nil, vb)...)
+		case !inb:
+			diffs = append(diffs, "- "+prefix+name)
+		default:
+			diffs = append(diffs, diffHash(prefix+name, va, vb)...)
+		}
+	}
+	return
+}
+
+// DiffRawConfig lists changes from a to b, one a line. "+ key" for added,
+// "- key" for removed and "~ key ..." for changed.
+func DiffRawConfig(a, b *RawConfig) (diffs []string) {
+	diffs = append(diffs, diffHash("default_node", a.DefaultNode, b.DefaultNode)...)
+	diffs = append(diffs, diffHashes("n:", a.Nodes, b.Nodes)...)
+	diffs = append(diffs, diffHashes("b:", a.Backends, b.Backends)...)
+	diffs = append(diffs, diffHashes("r:", a.Rewrites, b.Rewrites)...)
+	diffs = append(diffs, diffHashes("f:", a.Filters, b.Filters)...)
+
+	names := make(map[string]bool)
+	for name := range a.Measurements {
+		names[name] = true
+	}
+	for name := range b.Measurements {
+		names[name] = true
+	}
+
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		va, ina := a.Measurements[name]
+		vb, inb := b.Measurements[name]
+		sa, sb := strings.Join(va, ","), strings.Join(vb, ",")
+		switch {
+		case !ina:
+			diffs = append(diffs, fmt.Sprintf("+ m:%s [%s]", name, sb))
+		case !inb:
+			diffs = append(diffs, fmt.Sprintf("- m:%s", name))
+		case sa != sb:
+			diffs = append(diffs, fmt.Sprintf("~ m:%s [%s] -> [%s]", name, sa, sb))
+		}
+	}
+	return
+}
@@ -0,0 +1,47 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffRawConfig(t *testing.T) {
+	a := NewRawConfig()
+	a.DefaultNode["listenaddr"] = ":6666"
+	a.Nodes["l1"] = map[string]string{"db": "test"}
+	a.Backends["local"] = map[string]string{"url": "http://localhost:8086", "timeout": "10000"}
+	a.Backends["old"] = map[string]string{"url": "http://old:8086"}
+	a.Measurements["cpu"] = []string{"local"}
+	a.Measurements["mem"] = []string{"old"}
+
+	b := NewRawConfig()
+	b.DefaultNode["listenaddr"] = ":6666"
+	b.Nodes["l1"] = map[string]string{"db": "test", "zone": "local"}
+	b.Backends["local"] = map[string]string{"url": "http://localhost:8086", "timeout": "2000"}
+	b.Backends["new"] = map[string]string{"url": "http://new:8086"}
+	b.Measurements["cpu"] = []string{"local", "new"}
+	b.Measurements["disk"] = []string{"new"}
+
+	diffs := DiffRawConfig(a, b)
+	want := []string{
+		"~ n:l1 zone: + local",
+		"~ b:local timeout: 10000 -> 2000",
+		"+ b:new",
+		"~ b:new url: + http://new:8086",
+		"- b:old",
+		"~ m:cpu [local] -> [local,new]",
+		"+ m:disk [new]",
+		"- m:mem",
+	}
+	if !reflect.DeepEqual(diffs, want) {
+		t.Errorf("diff wrong:\n%v\n%v", diffs, want)
+	}
+
+	if len(DiffRawConfig(a, a)) != 0 {
+		t.Errorf("diff of same config")
+	}
+}
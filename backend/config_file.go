@@ -0,0 +1,386 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var (
+	ErrUnknownFormat = errors.New("unknown config file format")
+)
+
+// FileConfig is the layout of a config file, the same data config.py
+// writes into redis: default_node, nodes, backends and measurements.
+type FileConfig struct {
+	DefaultNode  map[string]interface{}            `json:"default_node" yaml:"default_node" toml:"default_node"`
+	Nodes        map[string]map[string]interface{} `json:"nodes" yaml:"nodes" toml:"nodes"`
+	Backends     map[string]map[string]interface{} `json:"backends" yaml:"backends" toml:"backends"`
+	Measurements map[string][]string               `json:"measurements" yaml:"measurements" toml:"measurements"`
+	Rewrites     map[string]map[string]interface{} `json:"rewrites" yaml:"rewrites" toml:"rewrites"`
+	Filters      map[string]map[string]interface{} `json:"filters" yaml:"filters" toml:"filters"`
+}
+
+func ParseFileConfig(p []byte, format string) (fc *FileConfig, err error) {
+	fc = &FileConfig{}
+	switch format {
+	case "json":
+		dec := json.NewDecoder(bytes.NewReader(p))
+		dec.UseNumber()
+		err = dec.Decode(fc)
+	case "yaml", "yml":
+		err = yaml.Unmarshal(p, fc)
+	case "toml":
+		_, err = toml.Decode(string(p), fc)
+	default:
+		err = ErrUnknownFormat
+	}
+	return
+}
+
+// ParseRawConfig parses config in layout of FileConfig.
+func ParseRawConfig(p []byte, format string) (raw *RawConfig, err error) {
+	fc, err := ParseFileConfig(p, format)
+	if err != nil {
+		return
+	}
+
+	raw = NewRawConfig()
+	raw.DefaultNode = stringifyMap(fc.DefaultNode)
+	for name, val := range fc.Nodes {
+		raw.Nodes[name] = stringifyMap(val)
+	}
+	for name, val := range fc.Backends {
+		raw.Backends[name] = stringifyMap(val)
+	}
+	if fc.Measurements != nil {
+		raw.Measurements = fc.Measurements
+	}
+	for name, val := range fc.Rewrites {
+		raw.Rewrites[name] = stringifyMap(val)
+	}
+	for name, val := range fc.Filters {
+		raw.Filters[name] = stringifyMap(val)
+	}
+	return
+}
+
+func MarshalRawConfig(raw *RawConfig, format string) (p []byte, err error) {
+	switch format {
+	case "json":
+		p, err = json.MarshalIndent(raw, "", "    ")
+		if err == nil {
+			p = append(p, '\n')
+		}
+	case "yaml", "yml":
+		p, err = yaml.Marshal(raw)
+	case "toml":
+		var buf bytes.Buffer
+		err = toml.NewEncoder(&buf).Encode(raw)
+		p = buf.Bytes()
+	default:
+		err = ErrUnknownFormat
+	}
+	return
+}
+
+// ParseConfigData parses a json object of one backend or node, values
+// may be strings, numbers or bools.
+func ParseConfigData(p []byte) (data map[string]string, err error) {
+	var m map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(p))
+	dec.UseNumber()
+	err = dec.Decode(&m)
+	if err != nil {
+		return
+	}
+	return stringifyMap(m), nil
+}
+
+// values in file may be numbers or lists, LoadStructFromMap wants strings,
+// lists joined by ',' as SplitList splits.
+func stringifyMap(m map[string]interface{}) (data map[string]string) {
+	data = make(map[string]string, len(m))
+	for k, v := range m {
+		val := reflect.ValueOf(v)
+		if val.Kind() != reflect.Slice {
+			data[strings.ToLower(k)] = fmt.Sprint(v)
+			continue
+		}
+		items := make([]string, val.Len())
+		for i := range items {
+			items[i] = fmt.Sprint(val.Index(i).Interface())
+		}
+		data[strings.ToLower(k)] = strings.Join(items, ",")
+	}
+	return
+}
+
+// FileConfigSource reads the config from a json, yaml or toml file.
+// The file is read again on every load, so /reload picks up changes.
+type FileConfigSource struct {
+	filename      string
+	format        string
+	node          string
+	unrouted_lock sync.Mutex
+}
+
+// FileFormat tells format of a config file by its extension.
+func FileFormat(filename string) (format string) {
+	return strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+}
+
+func NewFileConfigSource(filename string, node string) (fcs *FileConfigSource) {
+	fcs = &FileConfigSource{
+		filename: filename,
+		format:   FileFormat(filename),
+		node:     node,
+	}
+	return
+}
+
+func (fcs *FileConfigSource) LoadRaw() (raw *RawConfig, err error) {
+	p, err := ioutil.ReadFile(fcs.filename)
+	if err != nil {
+		log.Printf("read config file error: %s", err)
+		return
+	}
+
+	raw, err = ParseRawConfig(p, fcs.format)
+	if err != nil {
+		log.Printf("parse config file %s error: %s", fcs.filename, err)
+		return
+	}
+	return
+}
+
+// SaveRaw rewrites the file with raw. Comments and layout in file are lost.
+func (fcs *FileConfigSource) SaveRaw(raw *RawConfig) (err error) {
+	p, err := MarshalRawConfig(raw, fcs.format)
+	if err != nil {
+		return
+	}
+
+	err = writeFileAside(fcs.filename, p)
+	if err != nil {
+		log.Printf("write config file error: %s", err)
+		return
+	}
+	log.Printf("config file %s saved.", fcs.filename)
+	return
+}
+
+// write aside and rename, so readers never see a half written file. It
+// keeps mode of the file, 0644 for a new one.
+func writeFileAside(filename string, p []byte) (err error) {
+	var mode os.FileMode = 0644
+	if fi, err := os.Stat(filename); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(filename), ".influx-proxy")
+	if err != nil {
+		return
+	}
+	defer os.Remove(file.Name())
+
+	err = file.Chmod(mode)
+	if err == nil {
+		_, err = file.Write(p)
+	}
+	if err1 := file.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return
+	}
+	return os.Rename(file.Name(), filename)
+}
+
+// unrouted measurements are kept in <filename>.unrouted, a name a line.
+func (fcs *FileConfigSource) unroutedFile() string {
+	return fcs.filename + ".unrouted"
+}
+
+func (fcs *FileConfigSource) loadUnrouted() (set map[string]bool, err error) {
+	set = make(map[string]bool)
+	p, err := ioutil.ReadFile(fcs.unroutedFile())
+	if os.IsNotExist(err) {
+		return set, nil
+	}
+	if err != nil {
+		log.Printf("read unrouted file error: %s", err)
+		return
+	}
+
+	for _, name := range strings.Split(string(p), "\n") {
+		if name != "" {
+			set[name] = true
+		}
+	}
+	return
+}
+
+func (fcs *FileConfigSource) saveUnrouted(set map[string]bool) (err error) {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		buf.WriteString(name)
+		buf.WriteByte('\n')
+	}
+	err = writeFileAside(fcs.unroutedFile(), buf.Bytes())
+	if err != nil {
+		log.Printf("write unrouted file error: %s", err)
+	}
+	return
+}
+
+// update the unrouted file by fn, saved if fn tells it changed.
+func (fcs *FileConfigSource) updateUnrouted(fn func(set map[string]bool) bool) (err error) {
+	fcs.unrouted_lock.Lock()
+	defer fcs.unrouted_lock.Unlock()
+
+	set, err := fcs.loadUnrouted()
+	if err != nil {
+		return
+	}
+	if !fn(set) {
+		return
+	}
+	return fcs.saveUnrouted(set)
+}
+
+func (fcs *FileConfigSource) RecordUnrouted(names []string) (err error) {
+	return fcs.updateUnrouted(func(set map[string]bool) (changed bool) {
+		for _, name := range names {
+			if !set[name] {
+				set[name] = true
+				changed = true
+			}
+		}
+		return
+	})
+}
+
+func (fcs *FileConfigSource) LoadUnrouted() (names []string, err error) {
+	fcs.unrouted_lock.Lock()
+	defer fcs.unrouted_lock.Unlock()
+
+	set, err := fcs.loadUnrouted()
+	if err != nil {
+		return
+	}
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+func (fcs *FileConfigSource) RemoveUnrouted(names []string) (err error) {
+	return fcs.updateUnrouted(func(set map[string]bool) (changed bool) {
+		for _, name := range names {
+			if set[name] {
+				delete(set, name)
+				changed = true
+			}
+		}
+		return
+	})
+}
+
+func (fcs *FileConfigSource) LoadNodeLayers() (layers []ConfigLayer, err error) {
+	raw, err := fcs.LoadRaw()
+	if err != nil {
+		return
+	}
+	return raw.NodeLayers(fcs.node), nil
+}
+
+func (fcs *FileConfigSource) LoadNode() (nodecfg NodeConfig, err error) {
+	raw, err := fcs.LoadRaw()
+	if err != nil {
+		return
+	}
+
+	nodecfg, err = raw.NodeConfig(fcs.node)
+	if err != nil {
+		return
+	}
+	log.Printf("node config loaded.")
+	return
+}
+
+func (fcs *FileConfigSource) LoadBackends() (backends map[string]*BackendConfig, err error) {
+	raw, err := fcs.LoadRaw()
+	if err != nil {
+		return
+	}
+
+	backends, err = raw.BackendConfigs()
+	if err != nil {
+		return
+	}
+	log.Printf("%d backends loaded from file.", len(backends))
+	return
+}
+
+func (fcs *FileConfigSource) LoadMeasurements() (m_map map[string][]string, err error) {
+	raw, err := fcs.LoadRaw()
+	if err != nil {
+		return
+	}
+
+	m_map = raw.Measurements
+	log.Printf("%d measurements loaded from file.", len(m_map))
+	return
+}
+
+func (fcs *FileConfigSource) LoadRewrites() (rewrites map[string]*RewriteConfig, err error) {
+	raw, err := fcs.LoadRaw()
+	if err != nil {
+		return
+	}
+
+	rewrites, err = raw.RewriteConfigs()
+	if err != nil {
+		return
+	}
+	log.Printf("%d rewrites loaded from file.", len(rewrites))
+	return
+}
+
+func (fcs *FileConfigSource) LoadFilters() (filters map[string]*FilterConfig, err error) {
+	raw, err := fcs.LoadRaw()
+	if err != nil {
+		return
+	}
+
+	filters, err = raw.FilterConfigs()
+	if err != nil {
+		return
+	}
+	log.Printf("%d filters loaded from file.", len(filters))
+	return
+}
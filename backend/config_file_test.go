@@ -0,0 +1,210 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testConfigFiles = map[string]string{
+	"json": `{
+    "default_node": {"listenaddr": ":6666", "nexts": ["local2", "local"]},
+    "nodes": {"l1": {"db": "test", "zone": "local", "interval": 10}},
+    "backends": {
+        "local": {"url": "http://localhost:8086", "db": "test", "zone": "local", "timeoutquery": 1200000},
+        "local2": {"url": "http://influxdb-test:8086", "db": "test2", "interval": 200}
+    },
+    "measurements": {"cpu": ["local"], "temperature": ["local2", "local"]}
+}`,
+	"yaml": `
+default_node:
+  listenaddr: ":6666"
+  nexts: [local2, local]
+nodes:
+  l1:
+    db: test
+    zone: local
+    interval: 10
+backends:
+  local:
+    url: http://localhost:8086
+    db: test
+    zone: local
+    timeoutquery: 1200000
+  local2:
+    url: http://influxdb-test:8086
+    db: test2
+    interval: 200
+measurements:
+  cpu: [local]
+  temperature: [local2, local]
+`,
+	"toml": `
+[default_node]
+listenaddr = ":6666"
+nexts = ["local2", "local"]
+
+[nodes.l1]
+db = "test"
+zone = "local"
+interval = 10
+
+[backends.local]
+url = "http://localhost:8086"
+db = "test"
+zone = "local"
+timeoutquery = 1200000
+
+[backends.local2]
+url = "http://influxdb-test:8086"
+db = "test2"
+interval = 200
+
+[measurements]
+cpu = ["local"]
+temperature = ["local2", "local"]
+`,
+}
+
+func CreateTestConfigFile(t *testing.T, format string, content string) (filename string) {
+	file, err := ioutil.TempFile("", "influx-proxy")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(content)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	filename = file.Name() + "." + format
+	err = os.Rename(file.Name(), filename)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	return
+}
+
+func TestFileConfigSource(t *testing.T) {
+	for format, content := range testConfigFiles {
+		filename := CreateTestConfigFile(t, format, content)
+		defer os.Remove(filename)
+		fcs := NewFileConfigSource(filename, "l1")
+
+		nodecfg, err := fcs.LoadNode()
+		if err != nil {
+			t.Errorf("%s: %s", format, err)
+			continue
+		}
+		if nodecfg.ListenAddr != ":6666" || nodecfg.DB != "test" || nodecfg.Interval != 10*time.Second {
+			t.Errorf("%s: node config wrong: %+v", format, nodecfg)
+		}
+		if !reflect.DeepEqual(nodecfg.Nexts, []string{"local2", "local"}) {
+			t.Errorf("%s: list wrong: %v", format, nodecfg.Nexts)
+		}
+
+		backends, err := fcs.LoadBackends()
+		if err != nil {
+			t.Errorf("%s: %s", format, err)
+			continue
+		}
+		if len(backends) != 2 {
+			t.Errorf("%s: backends wrong: %d", format, len(backends))
+			continue
+		}
+		if backends["local"].TimeoutQuery != 20*time.Minute || backends["local"].Interval != time.Second {
+			t.Errorf("%s: backend local wrong: %+v", format, backends["local"])
+		}
+		if backends["local2"].Interval != 200*time.Millisecond || backends["local2"].Timeout != 10*time.Second {
+			t.Errorf("%s: backend local2 wrong: %+v", format, backends["local2"])
+		}
+
+		m_map, err := fcs.LoadMeasurements()
+		if err != nil {
+			t.Errorf("%s: %s", format, err)
+			continue
+		}
+		if len(m_map["temperature"]) != 2 || m_map["cpu"][0] != "local" {
+			t.Errorf("%s: measurements wrong: %v", format, m_map)
+		}
+	}
+}
+
+func TestFileConfigSourceUnknownFormat(t *testing.T) {
+	filename := CreateTestConfigFile(t, "ini", "listenaddr = :6666")
+	defer os.Remove(filename)
+
+	_, err := NewFileConfigSource(filename, "l1").LoadNode()
+	if err != ErrUnknownFormat {
+		t.Errorf("unknown format should fail: %v", err)
+	}
+}
+
+func TestMarshalRawConfig(t *testing.T) {
+	filename := CreateTestConfigFile(t, "json", testConfigFiles["json"])
+	defer os.Remove(filename)
+	raw, err := NewFileConfigSource(filename, "l1").LoadRaw()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	for _, format := range []string{"json", "yaml", "toml"} {
+		p, err := MarshalRawConfig(raw, format)
+		if err != nil {
+			t.Errorf("%s: %s", format, err)
+			continue
+		}
+
+		exported := CreateTestConfigFile(t, format, string(p))
+		defer os.Remove(exported)
+		loaded, err := NewFileConfigSource(exported, "l1").LoadRaw()
+		if err != nil {
+			t.Errorf("%s: %s", format, err)
+			continue
+		}
+		if !reflect.DeepEqual(raw, loaded) {
+			t.Errorf("%s: config changed after export: %v", format, DiffRawConfig(raw, loaded))
+		}
+	}
+}
+
+func TestWriteFileAside(t *testing.T) {
+	filename := CreateTestConfigFile(t, "json", "{}")
+	defer os.Remove(filename)
+	err := os.Chmod(filename, 0640)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	err = writeFileAside(filename, []byte(`{"measurements": {}}`))
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("mode not kept: %v", fi.Mode())
+	}
+
+	err = writeFileAside(filename+".new", []byte("{}"))
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer os.Remove(filename + ".new")
+	fi, err = os.Stat(filename + ".new")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if fi.Mode().Perm() != 0644 {
+		t.Errorf("mode of new file wrong: %v", fi.Mode())
+	}
+}
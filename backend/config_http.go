@@ -0,0 +1,234 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HttpConfigSource gets config from an url, in layout of FileConfig.
+// Json by default, yaml or toml if Content-Type says so. It uses ETag
+// to avoid downloading the same config again and again.
+type HttpConfigSource struct {
+	url      string
+	node     string
+	interval time.Duration
+	client   *http.Client
+
+	lock sync.Mutex
+	etag string
+	body []byte
+	raw  *RawConfig
+}
+
+func NewHttpConfigSource(url string, node string, interval time.Duration) (hcs *HttpConfigSource) {
+	hcs = &HttpConfigSource{
+		url:      url,
+		node:     node,
+		interval: interval,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	return
+}
+
+func contentFormat(content_type string) (format string) {
+	switch {
+	case strings.Contains(content_type, "yaml"):
+		return "yaml"
+	case strings.Contains(content_type, "toml"):
+		return "toml"
+	}
+	return "json"
+}
+
+// fetch config if it changed since last time.
+func (hcs *HttpConfigSource) fetch() (changed bool, err error) {
+	hcs.lock.Lock()
+	defer hcs.lock.Unlock()
+
+	req, err := http.NewRequest("GET", hcs.url, nil)
+	if err != nil {
+		return
+	}
+	if hcs.etag != "" && hcs.raw != nil {
+		req.Header.Set("If-None-Match", hcs.etag)
+	}
+
+	resp, err := hcs.client.Do(req)
+	if err != nil {
+		log.Printf("http config error: %s", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 304:
+		return
+	case 200:
+	default:
+		err = fmt.Errorf("http config status: %d", resp.StatusCode)
+		log.Print(err)
+		return
+	}
+
+	p, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("http config read error: %s", err)
+		return
+	}
+	// server may not support ETag.
+	if hcs.raw != nil && bytes.Equal(p, hcs.body) {
+		return
+	}
+
+	raw, err := ParseRawConfig(p, contentFormat(resp.Header.Get("Content-Type")))
+	if err != nil {
+		log.Printf("http config parse error: %s", err)
+		return
+	}
+
+	hcs.etag = resp.Header.Get("ETag")
+	hcs.body = p
+	hcs.raw = raw
+	changed = true
+	return
+}
+
+// Refresh fetches config once before a reload, so all loads of it read
+// the same version. A config fetched before is kept if it fails.
+func (hcs *HttpConfigSource) Refresh() (err error) {
+	_, err = hcs.fetch()
+	if err == nil {
+		return
+	}
+
+	hcs.lock.Lock()
+	defer hcs.lock.Unlock()
+	if hcs.raw != nil {
+		log.Printf("keep config fetched before: %s", hcs.url)
+		err = nil
+	}
+	return
+}
+
+// LoadRaw gives config fetched last time, fetches only if none.
+func (hcs *HttpConfigSource) LoadRaw() (raw *RawConfig, err error) {
+	hcs.lock.Lock()
+	raw = hcs.raw
+	hcs.lock.Unlock()
+	if raw != nil {
+		return
+	}
+
+	_, err = hcs.fetch()
+	if err != nil {
+		return
+	}
+
+	hcs.lock.Lock()
+	defer hcs.lock.Unlock()
+	return hcs.raw, nil
+}
+
+func (hcs *HttpConfigSource) LoadNodeLayers() (layers []ConfigLayer, err error) {
+	raw, err := hcs.LoadRaw()
+	if err != nil {
+		return
+	}
+	return raw.NodeLayers(hcs.node), nil
+}
+
+func (hcs *HttpConfigSource) LoadNode() (nodecfg NodeConfig, err error) {
+	raw, err := hcs.LoadRaw()
+	if err != nil {
+		return
+	}
+
+	nodecfg, err = raw.NodeConfig(hcs.node)
+	if err != nil {
+		return
+	}
+	log.Printf("node config loaded.")
+	return
+}
+
+func (hcs *HttpConfigSource) LoadBackends() (backends map[string]*BackendConfig, err error) {
+	raw, err := hcs.LoadRaw()
+	if err != nil {
+		return
+	}
+
+	backends, err = raw.BackendConfigs()
+	if err != nil {
+		return
+	}
+	log.Printf("%d backends loaded from http.", len(backends))
+	return
+}
+
+func (hcs *HttpConfigSource) LoadMeasurements() (m_map map[string][]string, err error) {
+	raw, err := hcs.LoadRaw()
+	if err != nil {
+		return
+	}
+
+	m_map = raw.Measurements
+	log.Printf("%d measurements loaded from http.", len(m_map))
+	return
+}
+
+func (hcs *HttpConfigSource) LoadRewrites() (rewrites map[string]*RewriteConfig, err error) {
+	raw, err := hcs.LoadRaw()
+	if err != nil {
+		return
+	}
+
+	rewrites, err = raw.RewriteConfigs()
+	if err != nil {
+		return
+	}
+	log.Printf("%d rewrites loaded from http.", len(rewrites))
+	return
+}
+
+func (hcs *HttpConfigSource) LoadFilters() (filters map[string]*FilterConfig, err error) {
+	raw, err := hcs.LoadRaw()
+	if err != nil {
+		return
+	}
+
+	filters, err = raw.FilterConfigs()
+	if err != nil {
+		return
+	}
+	log.Printf("%d filters loaded from http.", len(filters))
+	return
+}
+
+// Watch polls the url every interval, notify when config changed.
+func (hcs *HttpConfigSource) Watch(notify func()) (err error) {
+	go func() {
+		ticker := time.NewTicker(hcs.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			changed, err := hcs.fetch()
+			if err != nil {
+				continue
+			}
+			if changed {
+				log.Printf("config changed: %s", hcs.url)
+				notify()
+			}
+		}
+	}()
+	return
+}
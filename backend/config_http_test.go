@@ -0,0 +1,158 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testConfigServer struct {
+	lock     sync.Mutex
+	content  string
+	etag     string
+	requests int32
+	hits     int32
+}
+
+func (tcs *testConfigServer) set(content, etag string) {
+	tcs.lock.Lock()
+	defer tcs.lock.Unlock()
+	tcs.content = content
+	tcs.etag = etag
+}
+
+func (tcs *testConfigServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	tcs.lock.Lock()
+	defer tcs.lock.Unlock()
+	atomic.AddInt32(&tcs.requests, 1)
+
+	if tcs.etag != "" && req.Header.Get("If-None-Match") == tcs.etag {
+		atomic.AddInt32(&tcs.hits, 1)
+		w.WriteHeader(304)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-yaml")
+	if tcs.etag != "" {
+		w.Header().Set("ETag", tcs.etag)
+	}
+	w.Write([]byte(tcs.content))
+}
+
+func TestHttpConfigSource(t *testing.T) {
+	tcs := &testConfigServer{}
+	tcs.set(testConfigFiles["yaml"], `"v1"`)
+	ts := httptest.NewServer(tcs)
+	defer ts.Close()
+
+	hcs := NewHttpConfigSource(ts.URL, "l1", 50*time.Millisecond)
+	nodecfg, err := hcs.LoadNode()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if nodecfg.ListenAddr != ":6666" || nodecfg.DB != "test" {
+		t.Errorf("node config wrong: %+v", nodecfg)
+	}
+
+	backends, err := hcs.LoadBackends()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if len(backends) != 2 || backends["local2"].Interval != 200*time.Millisecond {
+		t.Errorf("backends wrong: %v", backends)
+	}
+	// loads read config fetched once.
+	if atomic.LoadInt32(&tcs.requests) != 1 {
+		t.Errorf("fetched %d times", tcs.requests)
+	}
+	err = hcs.Refresh()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if atomic.LoadInt32(&tcs.hits) != 1 {
+		t.Errorf("etag not used: %d hits", tcs.hits)
+	}
+
+	var count int32
+	err = hcs.Watch(func() {
+		atomic.AddInt32(&count, 1)
+	})
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if atomic.LoadInt32(&count) != 0 {
+		t.Errorf("notified without change: %d", count)
+	}
+
+	tcs.set(`{"measurements": {"cpu": ["local"]}}`, `"v2"`)
+	time.Sleep(200 * time.Millisecond)
+	// content type says yaml, but json is yaml too.
+	if atomic.LoadInt32(&count) != 1 {
+		t.Errorf("notified %d times after change", count)
+	}
+
+	m_map, err := hcs.LoadMeasurements()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if len(m_map) != 1 {
+		t.Errorf("measurements wrong: %v", m_map)
+	}
+}
+
+func TestHttpConfigSourceNoEtag(t *testing.T) {
+	tcs := &testConfigServer{}
+	tcs.set(testConfigFiles["yaml"], "")
+	ts := httptest.NewServer(tcs)
+	defer ts.Close()
+
+	hcs := NewHttpConfigSource(ts.URL, "l1", time.Second)
+	changed, err := hcs.fetch()
+	if err != nil || !changed {
+		t.Fatalf("first fetch: %v %s", changed, err)
+	}
+	changed, err = hcs.fetch()
+	if err != nil || changed {
+		t.Errorf("same body changed: %v %s", changed, err)
+	}
+}
+
+func TestHttpConfigSourceError(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	_, err := NewHttpConfigSource(ts.URL, "l1", time.Second).LoadNode()
+	if err == nil {
+		t.Errorf("404 should fail")
+	}
+	if NewHttpConfigSource(ts.URL, "l1", time.Second).Refresh() == nil {
+		t.Errorf("404 without config fetched should fail")
+	}
+
+	// config fetched before is kept.
+	tcs := &testConfigServer{}
+	tcs.set(testConfigFiles["yaml"], "")
+	ts2 := httptest.NewServer(tcs)
+	hcs := NewHttpConfigSource(ts2.URL, "l1", time.Second)
+	err = hcs.Refresh()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	ts2.Close()
+	err = hcs.Refresh()
+	if err != nil {
+		t.Errorf("error with config fetched: %s", err)
+	}
+	backends, err := hcs.LoadBackends()
+	if err != nil || len(backends) != 2 {
+		t.Errorf("backends wrong: %v %v", backends, err)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// ENV_PREFIX + upper case key overrides node config, like
+// INFLUX_PROXY_LISTENADDR for listenaddr.
+const ENV_PREFIX = "INFLUX_PROXY_"
+
+// ConfigLayer is one place node config comes from, like "n:l1" or "env".
+type ConfigLayer struct {
+	Name string
+	Data map[string]string
+}
+
+// NodeLayerSource is a ConfigSource which tells default_node and
+// n:<node> apart, so we know where every node field comes from.
+type NodeLayerSource interface {
+	LoadNodeLayers() (layers []ConfigLayer, err error)
+}
+
+// NodeConfigKeys lists keys of all fields in NodeConfig.
+func NodeConfigKeys() (keys []string) {
+	typ := reflect.TypeOf(NodeConfig{})
+	for i := 0; i < typ.NumField(); i++ {
+		keys = append(keys, ConfigKey(typ.Field(i)))
+	}
+	return
+}
+
+// EnvLayer reads node config from environment variables.
+func EnvLayer() (layer ConfigLayer) {
+	layer = ConfigLayer{Name: "env", Data: make(map[string]string)}
+	for _, key := range NodeConfigKeys() {
+		s, ok := os.LookupEnv(ENV_PREFIX + strings.ToUpper(key))
+		if ok {
+			layer.Data[key] = s
+		}
+	}
+	return
+}
+
+func (raw *RawConfig) NodeLayers(node string) (layers []ConfigLayer) {
+	return []ConfigLayer{
+		{Name: "default_node", Data: raw.DefaultNode},
+		{Name: "n:" + node, Data: raw.Nodes[node]},
+	}
+}
+
+// LoadNodeConfigLayers decodes node config from layers, later ones
+// override earlier. origins maps every key to the layer it comes from,
+// "default" if none.
+func LoadNodeConfigLayers(layers ...ConfigLayer) (nodecfg NodeConfig, origins map[string]string, err error) {
+	origins = make(map[string]string)
+	for _, key := range NodeConfigKeys() {
+		origins[key] = "default"
+	}
+
+	err = SetDefaults(&nodecfg)
+	if err != nil {
+		return
+	}
+	err = overrideNodeConfig(&nodecfg, origins, layers)
+	return
+}
+
+func overrideNodeConfig(nodecfg *NodeConfig, origins map[string]string, layers []ConfigLayer) (err error) {
+	for _, layer := range layers {
+		err = LoadStructFromMap(layer.Data, nodecfg)
+		if err != nil {
+			log.Printf("load error: %s", layer.Name)
+			return
+		}
+		for key, val := range layer.Data {
+			if _, ok := origins[key]; !ok {
+				continue
+			}
+			if field, ok := structField(nodecfg, key); ok && unsetDuration(field, val) {
+				continue
+			}
+			origins[key] = layer.Name
+		}
+	}
+	return
+}
+
+// LoadNodeWithOverrides loads node config from cfgsrc, and overrides it
+// by layers like env and flags. Fields from a source can't tell its
+// layers are marked as "source".
+func LoadNodeWithOverrides(cfgsrc ConfigSource, overrides ...ConfigLayer) (nodecfg NodeConfig, origins map[string]string, err error) {
+	if lsrc, ok := cfgsrc.(NodeLayerSource); ok {
+		var layers []ConfigLayer
+		layers, err = lsrc.LoadNodeLayers()
+		if err != nil {
+			return
+		}
+		return LoadNodeConfigLayers(append(layers, overrides...)...)
+	}
+
+	nodecfg, err = cfgsrc.LoadNode()
+	if err != nil {
+		return
+	}
+	origins = make(map[string]string)
+	for _, key := range NodeConfigKeys() {
+		origins[key] = "source"
+	}
+	err = overrideNodeConfig(&nodecfg, origins, overrides)
+	return
+}
+
+// DescribeNodeConfig formats every field as key=value(origin), for log.
+func DescribeNodeConfig(nodecfg *NodeConfig, origins map[string]string) string {
+	val := reflect.ValueOf(nodecfg).Elem()
+	items := make([]string, 0, val.NumField())
+	for i := 0; i < val.NumField(); i++ {
+		key := ConfigKey(val.Type().Field(i))
+		v := val.Field(i).Interface()
+		if l, ok := v.([]string); ok {
+			v = strings.Join(l, ",")
+		}
+		items = append(items, fmt.Sprintf("%s=%v(%s)", key, v, origins[key]))
+	}
+	return strings.Join(items, " ")
+}
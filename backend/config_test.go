@@ -0,0 +1,169 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDebounce(t *testing.T) {
+	var count int32
+	notify := Debounce(100*time.Millisecond, func() {
+		atomic.AddInt32(&count, 1)
+	})
+
+	// a bulk rewrite, hundreds of events.
+	for i := 0; i < 300; i++ {
+		notify()
+	}
+	time.Sleep(300 * time.Millisecond)
+	if atomic.LoadInt32(&count) != 1 {
+		t.Errorf("debounce called %d times", count)
+		return
+	}
+
+	notify()
+	time.Sleep(300 * time.Millisecond)
+	if atomic.LoadInt32(&count) != 2 {
+		t.Errorf("debounce called %d times", count)
+	}
+}
+
+func TestMergeEventFlags(t *testing.T) {
+	tests := []struct {
+		orig string
+		want string
+	}{
+		{orig: "", want: "Kg$hl"},
+		{orig: "Ex", want: "ExKg$hl"},
+		{orig: "Kgh", want: "Kgh$l"},
+		{orig: "KA", want: "KA"},
+		{orig: "EA", want: "EAK"},
+	}
+	for _, tt := range tests {
+		merged := mergeEventFlags(tt.orig, "Kg$hl")
+		if merged != tt.want {
+			t.Errorf("merge %q: %q != %q", tt.orig, merged, tt.want)
+		}
+	}
+}
+
+type testStruct struct {
+	Name     string        `config:"name" default:"unknown"`
+	Count    int           `default:"3"`
+	Enabled  bool          `config:"enabled"`
+	Ratio    float64       `config:"ratio" default:"0.5"`
+	Timeout  time.Duration `config:"timeout" default:"10s"`
+	Interval time.Duration `config:"interval" unit:"s"`
+	Tags     []string      `config:"tags"`
+}
+
+func TestLoadStructFromMap(t *testing.T) {
+	var o testStruct
+	err := SetDefaults(&o)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	want := testStruct{Name: "unknown", Count: 3, Ratio: 0.5, Timeout: 10 * time.Second}
+	if !reflect.DeepEqual(o, want) {
+		t.Errorf("defaults wrong: %+v", o)
+	}
+
+	err = LoadStructFromMap(map[string]string{
+		"name":     "test",
+		"count":    "5",
+		"enabled":  "1",
+		"ratio":    "0.25",
+		"timeout":  "1500",
+		"interval": "1m",
+		"tags":     "a, b,,c",
+		"Unknown":  "x",
+	}, &o)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	want = testStruct{
+		Name:     "test",
+		Count:    5,
+		Enabled:  true,
+		Ratio:    0.25,
+		Timeout:  1500 * time.Millisecond,
+		Interval: time.Minute,
+		Tags:     []string{"a", "b", "c"},
+	}
+	if !reflect.DeepEqual(o, want) {
+		t.Errorf("load wrong: %+v", o)
+	}
+
+	err = LoadStructFromMap(map[string]string{"interval": "30"}, &o)
+	if err != nil || o.Interval != 30*time.Second {
+		t.Errorf("duration in unit wrong: %s %s", o.Interval, err)
+	}
+
+	cfg, err := LoadBackendConfig(map[string]string{"rewriteinterval": "0", "checkinterval": "-1s", "timeout": "0s"})
+	if err != nil || cfg.RewriteInterval != 10*time.Second || cfg.CheckInterval != time.Second || cfg.Timeout != 10*time.Second {
+		t.Errorf("zero duration not taken as unset: %+v %v", cfg, err)
+	}
+
+	for _, data := range []map[string]string{
+		{"count": "x"},
+		{"enabled": "yes"},
+		{"ratio": "half"},
+		{"timeout": "10 years"},
+	} {
+		if LoadStructFromMap(data, &o) == nil {
+			t.Errorf("illegal value passed: %v", data)
+		}
+	}
+}
+
+func TestLoadNodeConfigLayers(t *testing.T) {
+	os.Setenv("INFLUX_PROXY_LISTENADDR", ":7777")
+	os.Setenv("INFLUX_PROXY_WRITETRACING", "true")
+	defer os.Unsetenv("INFLUX_PROXY_LISTENADDR")
+	defer os.Unsetenv("INFLUX_PROXY_WRITETRACING")
+
+	raw := NewRawConfig()
+	raw.DefaultNode = map[string]string{"listenaddr": ":6666", "db": "test", "zone": "a"}
+	raw.Nodes["l1"] = map[string]string{"zone": "local"}
+	flags := ConfigLayer{Name: "flag", Data: map[string]string{"db": "flagdb", "idletimeout": "30"}}
+
+	layers := append(raw.NodeLayers("l1"), EnvLayer(), flags)
+	nodecfg, origins, err := LoadNodeConfigLayers(layers...)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	if nodecfg.ListenAddr != ":7777" || nodecfg.DB != "flagdb" || nodecfg.Zone != "local" ||
+		!nodecfg.WriteTracing || nodecfg.IdleTimeout != 30*time.Second || nodecfg.Interval != 10*time.Second {
+		t.Errorf("node config wrong: %+v", nodecfg)
+	}
+
+	want := map[string]string{
+		"listenaddr":   "env",
+		"db":           "flag",
+		"zone":         "n:l1",
+		"nexts":        "default",
+		"interval":     "default",
+		"idletimeout":  "flag",
+		"writetracing": "env",
+		"querytracing": "default",
+		"autoregister": "default",
+		"futurelimit":  "default",
+		"futureaction": "default",
+	}
+	if !reflect.DeepEqual(origins, want) {
+		t.Errorf("origins wrong: %v", origins)
+	}
+
+	_, _, err = LoadNodeConfigLayers(ConfigLayer{Name: "env", Data: map[string]string{"interval": "x"}})
+	if err == nil {
+		t.Errorf("illegal override passed")
+	}
+}
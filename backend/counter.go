@@ -0,0 +1,61 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"sync/atomic"
+)
+
+// ruleCounter counts points taken by a rule, of rewrites or filters.
+type ruleCounter struct {
+	name     string
+	count    int64
+	reported int64
+}
+
+func (c *ruleCounter) add() {
+	atomic.AddInt64(&c.count, 1)
+}
+
+// Count is the number of points taken by the rule.
+func (c *ruleCounter) Count() int64 {
+	return atomic.LoadInt64(&c.count)
+}
+
+// ruleCounters are counters of all rules in a rewriter or filter, counted
+// on across reloads while a rule keeps its name.
+type ruleCounters []*ruleCounter
+
+// inherit counts of rules with the same name from orig, after a reload.
+func (cs ruleCounters) inherit(orig ruleCounters) {
+	counters := make(map[string]*ruleCounter, len(orig))
+	for _, c := range orig {
+		counters[c.name] = c
+	}
+	for _, c := range cs {
+		if o, ok := counters[c.name]; ok {
+			c.count = atomic.LoadInt64(&o.count)
+			c.reported = atomic.LoadInt64(&o.reported)
+		}
+	}
+}
+
+// counts since last call, for statistics.
+func (cs ruleCounters) deltas() (deltas map[string]int64) {
+	deltas = make(map[string]int64, len(cs))
+	for _, c := range cs {
+		count := c.Count()
+		deltas[c.name] = count - atomic.SwapInt64(&c.reported, count)
+	}
+	return
+}
+
+func (cs ruleCounters) counts() (counts map[string]int64) {
+	counts = make(map[string]int64, len(cs))
+	for _, c := range cs {
+		counts[c.name] = c.Count()
+	}
+	return
+}
@@ -0,0 +1,221 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLetterNotFound = errors.New("dead letter not found")
+)
+
+// LetterNotFoundError tells ids of letters not found, of many asked.
+type LetterNotFoundError struct {
+	IDs []int64
+}
+
+func (e *LetterNotFoundError) Error() string {
+	ids := make([]string, len(e.IDs))
+	for i, id := range e.IDs {
+		ids[i] = strconv.FormatInt(id, 10)
+	}
+	return ErrLetterNotFound.Error() + ": " + strings.Join(ids, ", ")
+}
+
+// Letter is lines a backend refused, with the reason it told. ID is
+// unique in a dead letter file.
+type Letter struct {
+	ID      int64  `json:"id"`
+	Time    int64  `json:"time"`
+	Backend string `json:"backend"`
+	Reason  string `json:"reason"`
+	Params  string `json:"params,omitempty"`
+	Points  int    `json:"points"`
+	Lines   string `json:"lines,omitempty"`
+}
+
+// WriteParams gives params the lines were written with.
+func (letter *Letter) WriteParams() (params WriteParams, err error) {
+	q, err := url.ParseQuery(letter.Params)
+	if err != nil {
+		return
+	}
+	return ParseWriteParams(q)
+}
+
+// DeadLetter keeps letters of a backend in <filename>.dead, one json per
+// line, so data refused is never lost silently.
+type DeadLetter struct {
+	lock     sync.Mutex
+	filename string
+	backend  string
+	next     int64 // next id, 0 till file read
+}
+
+func NewDeadLetter(filename string, backend string) (dl *DeadLetter) {
+	return &DeadLetter{filename: filename + ".dead", backend: backend}
+}
+
+func (dl *DeadLetter) load() (letters []*Letter, err error) {
+	file, err := os.Open(dl.filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		letter := &Letter{}
+		err = json.Unmarshal(scanner.Bytes(), letter)
+		if err != nil {
+			log.Printf("bad dead letter in %s: %s\n", dl.filename, err)
+			continue
+		}
+		letters = append(letters, letter)
+	}
+	err = scanner.Err()
+	return
+}
+
+func (dl *DeadLetter) save(letters []*Letter) (err error) {
+	if len(letters) == 0 {
+		err = os.Remove(dl.filename)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, letter := range letters {
+		err = enc.Encode(letter)
+		if err != nil {
+			return
+		}
+	}
+	return writeFileAside(dl.filename, buf.Bytes())
+}
+
+// Append keeps lines refused for reason.
+func (dl *DeadLetter) Append(lines []byte, params WriteParams, reason string) (err error) {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	if dl.next == 0 {
+		var letters []*Letter
+		letters, err = dl.load()
+		if err != nil {
+			return
+		}
+		dl.next = 1
+		for _, letter := range letters {
+			if letter.ID >= dl.next {
+				dl.next = letter.ID + 1
+			}
+		}
+	}
+
+	p, err := json.Marshal(&Letter{
+		ID:      dl.next,
+		Time:    time.Now().UnixNano(),
+		Backend: dl.backend,
+		Reason:  reason,
+		Params:  params.Values().Encode(),
+		Points:  bytes.Count(lines, []byte{'\n'}),
+		Lines:   string(lines),
+	})
+	if err != nil {
+		return
+	}
+
+	file, err := os.OpenFile(dl.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Print("open dead letter error: ", err)
+		return
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(p, '\n'))
+	if err != nil {
+		return
+	}
+	dl.next++
+	return
+}
+
+// List gives all letters in order of ids.
+func (dl *DeadLetter) List() (letters []*Letter, err error) {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+	return dl.load()
+}
+
+func (dl *DeadLetter) Get(id int64) (letter *Letter, err error) {
+	letters, err := dl.List()
+	if err != nil {
+		return
+	}
+	for _, letter = range letters {
+		if letter.ID == id {
+			return
+		}
+	}
+	return nil, ErrLetterNotFound
+}
+
+// Remove drops letters of ids, all of them if no id given. Nothing is
+// dropped if any of ids not found, a *LetterNotFoundError tells them.
+func (dl *DeadLetter) Remove(ids ...int64) (err error) {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	if len(ids) == 0 {
+		return dl.save(nil)
+	}
+
+	letters, err := dl.load()
+	if err != nil {
+		return
+	}
+	exists := make(map[int64]bool, len(letters))
+	for _, letter := range letters {
+		exists[letter.ID] = true
+	}
+	drop := make(map[int64]bool, len(ids))
+	var missing []int64
+	for _, id := range ids {
+		if !exists[id] {
+			missing = append(missing, id)
+		}
+		drop[id] = true
+	}
+	if len(missing) > 0 {
+		return &LetterNotFoundError{IDs: missing}
+	}
+
+	kept := letters[:0]
+	for _, letter := range letters {
+		if !drop[letter.ID] {
+			kept = append(kept, letter)
+		}
+	}
+	return dl.save(kept)
+}
@@ -0,0 +1,131 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDeadLetter(t *testing.T) {
+	defer os.Remove("deadletter.dead")
+	dl := NewDeadLetter("deadletter", "local")
+
+	err := dl.Append([]byte("cpu value=1\ncpu value=2\n"), WriteParams{RP: "week"}, "database not found: test")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	err = dl.Append([]byte("cpu value=\"x\"\n"), WriteParams{}, "field type conflict")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	letters, err := dl.List()
+	if err != nil || len(letters) != 2 {
+		t.Fatalf("letters wrong: %v %v", letters, err)
+	}
+	letter := letters[0]
+	if letter.ID != 1 || letter.Backend != "local" || letter.Points != 2 || letter.Reason != "database not found: test" {
+		t.Errorf("letter wrong: %+v", letter)
+	}
+	if params, err := letter.WriteParams(); err != nil || params.RP != "week" {
+		t.Errorf("params wrong: %+v %v", params, err)
+	}
+
+	// ids go on after file read again.
+	dl = NewDeadLetter("deadletter", "local")
+	err = dl.Append([]byte("mem value=1\n"), WriteParams{}, "field type conflict")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	letter, err = dl.Get(3)
+	if err != nil || letter.Lines != "mem value=1\n" {
+		t.Errorf("letter wrong: %+v %v", letter, err)
+	}
+
+	err = dl.Remove(2)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if _, err = dl.Get(2); err != ErrLetterNotFound {
+		t.Errorf("letter not removed: %v", err)
+	}
+	if err = dl.Remove(2); err == nil || err.Error() != "dead letter not found: 2" {
+		t.Errorf("removed twice: %v", err)
+	}
+	// none removed if any not found.
+	err = dl.Remove(1, 2, 5)
+	if e, ok := err.(*LetterNotFoundError); !ok || !reflect.DeepEqual(e.IDs, []int64{2, 5}) {
+		t.Errorf("not found wrong: %v", err)
+	}
+	if _, err = dl.Get(1); err != nil {
+		t.Errorf("letter removed: %v", err)
+	}
+
+	err = dl.Remove()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	letters, err = dl.List()
+	if err != nil || len(letters) != 0 {
+		t.Errorf("letters not purged: %v %v", letters, err)
+	}
+}
+
+func TestBackendsReplay(t *testing.T) {
+	var status int32 = 404
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			w.WriteHeader(int(atomic.LoadInt32(&status)))
+			return
+		}
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	cfg, _ := CreateTestBackendConfig("replay")
+	cfg.URL = ts.URL
+	bs, err := NewBackends(cfg, "replay")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer bs.Close()
+	defer os.Remove("replay.dead")
+
+	for i := 0; i < 3; i++ {
+		err = bs.DeadLetters().Append([]byte("cpu value=1\n"), WriteParams{}, "database not found: replay")
+		if err != nil {
+			t.Fatalf("error: %s", err)
+		}
+	}
+
+	replayed, failed, err := bs.Replay(2)
+	if err != nil || replayed != 0 || failed != 1 {
+		t.Errorf("replay wrong: %d %d %v", replayed, failed, err)
+	}
+
+	// database created since.
+	atomic.StoreInt32(&status, 204)
+	replayed, failed, err = bs.Replay(2)
+	if err != nil || replayed != 1 || failed != 0 {
+		t.Errorf("replay wrong: %d %d %v", replayed, failed, err)
+	}
+	replayed, failed, err = bs.Replay()
+	if err != nil || replayed != 2 || failed != 0 {
+		t.Errorf("replay all wrong: %d %d %v", replayed, failed, err)
+	}
+	letters, err := bs.DeadLetters().List()
+	if err != nil || len(letters) != 0 {
+		t.Errorf("letters replayed not dropped: %v %v", letters, err)
+	}
+
+	if _, _, err = bs.Replay(9); err != ErrLetterNotFound {
+		t.Errorf("replay of no letter: %v", err)
+	}
+}
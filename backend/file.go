@@ -8,12 +8,17 @@ import (
 	"encoding/binary"
 	"io"
 	"log"
+	"net/url"
 	"os"
 	"sync"
 )
 
+// flag in record length, the record has write params.
+const RECORD_PARAMS = 1 << 31
+
 type FileBackend struct {
 	lock     sync.Mutex
+	rlock    sync.Mutex // for a whole read-rewrite-update round
 	filename string
 	dataflag bool
 	producer *os.File
@@ -55,17 +60,37 @@ func NewFileBackend(filename string) (fb *FileBackend, err error) {
 	return
 }
 
-func (fb *FileBackend) Write(p []byte) (err error) {
+// Write appends a record of p. Records with params have RECORD_PARAMS set
+// in length, and params encoded as a query string before data. Records
+// without params are the same as in old files.
+func (fb *FileBackend) Write(p []byte, params WriteParams) (err error) {
 	fb.lock.Lock()
 	defer fb.lock.Unlock()
 
+	header := params.Values().Encode()
 	var length uint32 = uint32(len(p))
+	if header != "" {
+		length |= RECORD_PARAMS
+	}
 	err = binary.Write(fb.producer, binary.BigEndian, length)
 	if err != nil {
 		log.Print("write length error: ", err)
 		return
 	}
 
+	if header != "" {
+		err = binary.Write(fb.producer, binary.BigEndian, uint16(len(header)))
+		if err != nil {
+			log.Print("write header error: ", err)
+			return
+		}
+		_, err = io.WriteString(fb.producer, header)
+		if err != nil {
+			log.Print("write header error: ", err)
+			return
+		}
+	}
+
 	n, err := fb.producer.Write(p)
 	if err != nil {
 		log.Print("write error: ", err)
@@ -92,9 +117,9 @@ func (fb *FileBackend) IsData() (dataflag bool) {
 }
 
 // FIXME: signal here
-func (fb *FileBackend) Read() (p []byte, err error) {
+func (fb *FileBackend) Read() (p []byte, params WriteParams, err error) {
 	if !fb.IsData() {
-		return nil, nil
+		return nil, params, nil
 	}
 
 	var length uint32
@@ -105,6 +130,14 @@ func (fb *FileBackend) Read() (p []byte, err error) {
 		return
 	}
 
+	if length&RECORD_PARAMS != 0 {
+		length &^= RECORD_PARAMS
+		params, err = fb.readParams()
+		if err != nil {
+			return
+		}
+	}
+
 	p = make([]byte, length)
 
 	_, err = io.ReadFull(fb.consumer, p)
@@ -115,6 +148,34 @@ func (fb *FileBackend) Read() (p []byte, err error) {
 	return
 }
 
+func (fb *FileBackend) readParams() (params WriteParams, err error) {
+	var hlen uint16
+	err = binary.Read(fb.consumer, binary.BigEndian, &hlen)
+	if err != nil {
+		log.Print("read header error: ", err)
+		return
+	}
+
+	header := make([]byte, hlen)
+	_, err = io.ReadFull(fb.consumer, header)
+	if err != nil {
+		log.Print("read header error: ", err)
+		return
+	}
+
+	q, err := url.ParseQuery(string(header))
+	if err != nil {
+		log.Print("parse header error: ", err)
+		return
+	}
+	params = WriteParams{
+		Precision:   q.Get("precision"),
+		RP:          q.Get("rp"),
+		Consistency: q.Get("consistency"),
+	}
+	return
+}
+
 func (fb *FileBackend) CleanUp() (err error) {
 	_, err = fb.consumer.Seek(0, os.SEEK_SET)
 	if err != nil {
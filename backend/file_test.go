@@ -11,7 +11,7 @@ import (
 )
 
 func readAndProcess(t *testing.T, fb *FileBackend, s string, l int64) {
-	p, err := fb.Read()
+	p, _, err := fb.Read()
 	if err != nil {
 		t.Errorf("error: %s", err)
 		return
@@ -49,13 +49,13 @@ func TestFileBackend(t *testing.T) {
 		return
 	}
 
-	err = fb.Write([]byte("data"))
+	err = fb.Write([]byte("data"), WriteParams{})
 	if err != nil {
 		t.Errorf("error: %s", err)
 		return
 	}
 
-	err = fb.Write([]byte("full"))
+	err = fb.Write([]byte("full"), WriteParams{})
 	if err != nil {
 		t.Errorf("error: %s", err)
 		return
@@ -64,3 +64,28 @@ func TestFileBackend(t *testing.T) {
 	readAndProcess(t, fb, "data", 16)
 	readAndProcess(t, fb, "full", 0)
 }
+
+func TestFileBackendParams(t *testing.T) {
+	fb, err := NewFileBackend("../testparams")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer os.Remove("../testparams.dat")
+	defer os.Remove("../testparams.rec")
+	defer fb.Close()
+
+	params := WriteParams{Precision: "s", RP: "week"}
+	for _, wp := range []WriteParams{params, {}} {
+		err = fb.Write([]byte("cpu value=1 1000"), wp)
+		if err != nil {
+			t.Fatalf("error: %s", err)
+		}
+	}
+
+	for _, want := range []WriteParams{params, {}} {
+		p, wp, err := fb.Read()
+		if err != nil || string(p) != "cpu value=1 1000" || wp != want {
+			t.Errorf("record wrong: %s %+v %v", p, wp, err)
+		}
+	}
+}
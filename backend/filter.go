@@ -0,0 +1,205 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrIllegalFilter = errors.New("illegal filter rule")
+)
+
+// FilterConfig is a drop rule, f:<name> in config. A point matching all
+// conditions set is dropped. Measurement is like in RewriteConfig. Tags
+// are keys a point has, or pairs like "region=eu" it has. Fields are
+// keys a point has. Addrs are ips or cidrs of clients.
+type FilterConfig struct {
+	Measurement string   `config:"measurement"`
+	DB          string   `config:"db"`
+	Tags        []string `config:"tags"`
+	Fields      []string `config:"fields"`
+	Addrs       []string `config:"addrs"`
+}
+
+// LoadFilterConfig decodes a filter rule definition.
+func LoadFilterConfig(data map[string]string) (cfg *FilterConfig, err error) {
+	cfg = &FilterConfig{}
+	err = SetDefaults(cfg)
+	if err != nil {
+		return
+	}
+	err = LoadStructFromMap(data, cfg)
+	return
+}
+
+type FilterRule struct {
+	ruleCounter // points dropped
+	db          string
+	match       func(s string) bool
+	tags        map[string]*string // nil value for any
+	fields      []string
+	nets        []*net.IPNet
+}
+
+func NewFilterRule(name string, cfg *FilterConfig) (rule *FilterRule, err error) {
+	rule = &FilterRule{ruleCounter: ruleCounter{name: name}, db: cfg.DB, fields: cfg.Fields}
+	if cfg.Measurement == "" && cfg.DB == "" && len(cfg.Tags) == 0 &&
+		len(cfg.Fields) == 0 && len(cfg.Addrs) == 0 {
+		return nil, ErrIllegalFilter
+	}
+
+	if cfg.Measurement != "" {
+		rule.match, _, err = compileMeasurement(cfg.Measurement)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(cfg.Tags) > 0 {
+		rule.tags = make(map[string]*string, len(cfg.Tags))
+	}
+	for _, item := range cfg.Tags {
+		kv := strings.SplitN(item, "=", 2)
+		if kv[0] == "" {
+			return nil, ErrIllegalFilter
+		}
+		rule.tags[kv[0]] = nil
+		if len(kv) == 2 {
+			rule.tags[kv[0]] = &kv[1]
+		}
+	}
+
+	for _, addr := range cfg.Addrs {
+		if strings.IndexByte(addr, '/') == -1 {
+			if strings.IndexByte(addr, ':') == -1 {
+				addr += "/32"
+			} else {
+				addr += "/128"
+			}
+		}
+		var ipnet *net.IPNet
+		_, ipnet, err = net.ParseCIDR(addr)
+		if err != nil {
+			return nil, err
+		}
+		rule.nets = append(rule.nets, ipnet)
+	}
+	return
+}
+
+func (rule *FilterRule) matchAddr(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range rule.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *FilterRule) matchPoint(p *Point) bool {
+	for key, value := range rule.tags {
+		found := false
+		for _, tag := range p.Tags {
+			if tag.Key == key && (value == nil || tag.Value == *value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for _, key := range rule.fields {
+		found := false
+		for _, field := range p.Fields {
+			if field.Key == key {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Filter drops points by filter rules, the first rule matches counts.
+type Filter struct {
+	rules []*FilterRule
+}
+
+func NewFilter(cfgs map[string]*FilterConfig) (f *Filter, err error) {
+	f = &Filter{}
+	for name, cfg := range cfgs {
+		var rule *FilterRule
+		rule, err = NewFilterRule(name, cfg)
+		if err != nil {
+			return
+		}
+		f.rules = append(f.rules, rule)
+	}
+	sort.Slice(f.rules, func(i, j int) bool { return f.rules[i].name < f.rules[j].name })
+	return
+}
+
+func (f *Filter) counters() (cs ruleCounters) {
+	for _, rule := range f.rules {
+		cs = append(cs, &rule.ruleCounter)
+	}
+	return
+}
+
+// Inherit counters of rules with the same name from orig, after a reload.
+func (f *Filter) Inherit(orig *Filter) {
+	if orig == nil {
+		return
+	}
+	f.counters().inherit(orig.counters())
+}
+
+func (f *Filter) Len() int {
+	return len(f.rules)
+}
+
+// Drop tells if point p, written to db by client addr, should be dropped.
+func (f *Filter) Drop(db string, addr string, p *Point) (drop bool) {
+	for _, rule := range f.rules {
+		if rule.db != "" && rule.db != db {
+			continue
+		}
+		if rule.match != nil && !rule.match(p.Measurement) {
+			continue
+		}
+		if len(rule.nets) > 0 && !rule.matchAddr(addr) {
+			continue
+		}
+		if !rule.matchPoint(p) {
+			continue
+		}
+
+		rule.add()
+		return true
+	}
+	return
+}
+
+func (f *Filter) deltas() (deltas map[string]int64) {
+	return f.counters().deltas()
+}
+
+// DropCounts gives points dropped by every rule.
+func (f *Filter) DropCounts() (counts map[string]int64) {
+	return f.counters().counts()
+}
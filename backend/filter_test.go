@@ -0,0 +1,70 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	f, err := NewFilter(map[string]*FilterConfig{
+		"flood":  {Measurement: "glob:spam_*"},
+		"userid": {Measurement: "http", Tags: []string{"user_id"}},
+		"eu":     {Tags: []string{"region=eu"}, Fields: []string{"debug"}},
+		"client": {DB: "mydb", Addrs: []string{"10.0.0.0/8", "192.168.1.1"}},
+	})
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	tests := []struct {
+		db   string
+		addr string
+		line string
+		drop bool
+	}{
+		{line: "spam_x value=1", drop: true},
+		{line: "http,user_id=3 value=1", drop: true},
+		{line: "http,host=a value=1", drop: false},
+		{line: "cpu,region=eu value=1,debug=1", drop: true},
+		{line: "cpu,region=us value=1,debug=1", drop: false},
+		{line: "cpu,region=eu value=1", drop: false},
+		{db: "mydb", addr: "10.1.2.3", line: "cpu value=1", drop: true},
+		{db: "mydb", addr: "192.168.1.1", line: "cpu value=1", drop: true},
+		{db: "mydb", addr: "192.168.1.2", line: "cpu value=1", drop: false},
+		{db: "other", addr: "10.1.2.3", line: "cpu value=1", drop: false},
+	}
+	for _, tt := range tests {
+		p, err := ParsePoint([]byte(tt.line))
+		if err != nil {
+			t.Fatalf("%s: %s", tt.line, err)
+		}
+		if drop := f.Drop(tt.db, tt.addr, p); drop != tt.drop {
+			t.Errorf("%s from %s: drop %v", tt.line, tt.addr, drop)
+		}
+	}
+
+	counts := f.DropCounts()
+	if counts["flood"] != 1 || counts["userid"] != 1 || counts["eu"] != 1 || counts["client"] != 2 {
+		t.Errorf("counts wrong: %v", counts)
+	}
+	if deltas := f.deltas(); deltas["client"] != 2 {
+		t.Errorf("deltas wrong: %v", deltas)
+	}
+	if deltas := f.deltas(); deltas["client"] != 0 {
+		t.Errorf("deltas not reset: %v", deltas)
+	}
+
+	for _, cfg := range []*FilterConfig{
+		{},
+		{Addrs: []string{"10.0.0.300"}},
+		{Tags: []string{"=eu"}},
+		{Measurement: "re:("},
+	} {
+		if _, err = NewFilterRule("bad", cfg); err == nil {
+			t.Errorf("illegal filter passed: %+v", cfg)
+		}
+	}
+}
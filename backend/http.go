@@ -7,12 +7,14 @@ package backend
 import (
 	"bytes"
 	"compress/gzip"
+	"encoding/json"
 	"errors"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -38,26 +40,38 @@ func Compress(buf *bytes.Buffer, p []byte) (err error) {
 	return
 }
 
+// Decompress gives data compressed by Compress.
+func Decompress(p []byte) (data []byte, err error) {
+	zip, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return
+	}
+	defer zip.Close()
+	return ioutil.ReadAll(zip)
+}
+
 type HttpBackend struct {
 	client    *http.Client
 	transport http.Transport
-	Interval  int
+	Interval  time.Duration
 	URL       string
 	DB        string
 	Zone      string
 	Active    bool
 	running   bool
-	WriteOnly int
+	WriteOnly bool
+	// CREATE DATABASE statement if autocreate set.
+	create_db string
 }
 
 func NewHttpBackend(cfg *BackendConfig) (hb *HttpBackend) {
 	hb = &HttpBackend{
 		client: &http.Client{
-			Timeout: time.Millisecond * time.Duration(cfg.Timeout),
+			Timeout: cfg.Timeout,
 		},
 		// TODO: query timeout? use req.Cancel
 		// client_query: &http.Client{
-		// 	Timeout: time.Millisecond * time.Duration(cfg.TimeoutQuery),
+		// 	Timeout: cfg.TimeoutQuery,
 		// },
 		Interval:  cfg.CheckInterval,
 		URL:       cfg.URL,
@@ -67,6 +81,9 @@ func NewHttpBackend(cfg *BackendConfig) (hb *HttpBackend) {
 		running:   true,
 		WriteOnly: cfg.WriteOnly,
 	}
+	if cfg.AutoCreate {
+		hb.create_db = CreateDatabaseQuery(cfg.DB, cfg.AutoCreateRP, cfg.AutoCreateDuration)
+	}
 	go hb.CheckActive()
 	return
 }
@@ -78,15 +95,12 @@ func (hb *HttpBackend) CheckActive() {
 	for hb.running {
 		_, err = hb.Ping()
 		hb.Active = (err == nil)
-		time.Sleep(time.Millisecond * time.Duration(hb.Interval))
+		time.Sleep(hb.Interval)
 	}
 }
 
 func (hb *HttpBackend) IsWriteOnly() bool {
-	if hb.WriteOnly == 0 {
-		return false
-	}
-	return true
+	return hb.WriteOnly
 }
 
 func (hb *HttpBackend) IsActive() bool {
@@ -166,27 +180,111 @@ func (hb *HttpBackend) Query(w http.ResponseWriter, req *http.Request) (err erro
 	return
 }
 
-func (hb *HttpBackend) Write(p []byte) (err error) {
+func (hb *HttpBackend) Write(p []byte, params WriteParams) (err error) {
+	log.Printf("http backend write %s", hb.DB)
+	_, err = hb.write(p, params)
+	return
+}
+
+func (hb *HttpBackend) WriteCompressed(p []byte, params WriteParams) (err error) {
+	_, err = hb.writeCompressed(p, params)
+	return
+}
+
+// write is Write giving reason the backend told for an error.
+func (hb *HttpBackend) write(p []byte, params WriteParams) (reason string, err error) {
 	var buf bytes.Buffer
 	err = Compress(&buf, p)
 	if err != nil {
 		log.Print("compress error: ", err)
 		return
 	}
+	return hb.writeCompressed(buf.Bytes(), params)
+}
 
-	log.Printf("http backend write %s", hb.DB)
-	err = hb.WriteStream(&buf, true)
+// writeCompressed writes p compressed, if db not found and autocreate set,
+// creates db and writes again.
+func (hb *HttpBackend) writeCompressed(p []byte, params WriteParams) (reason string, err error) {
+	reason, err = hb.writeStream(bytes.NewReader(p), true, params)
+	if err != ErrNotFound || hb.create_db == "" || !strings.HasPrefix(reason, "database not found") {
+		return
+	}
+
+	cerr := hb.CreateDatabase()
+	if cerr != nil {
+		log.Printf("create database %s error: %s\n", hb.DB, cerr)
+		return
+	}
+	log.Printf("database %s created in %s\n", hb.DB, hb.URL)
+	return hb.writeStream(bytes.NewReader(p), true, params)
+}
+
+// CreateDatabaseQuery gives the statement creating db, with retention
+// policy rp as default if not empty.
+func CreateDatabaseQuery(db string, rp string, duration time.Duration) (q string) {
+	q = "CREATE DATABASE " + quoteIdent(db)
+	if rp == "" {
+		return
+	}
+	q += " WITH"
+	if duration > 0 {
+		q += " DURATION " + strconv.FormatInt(int64(duration/time.Second), 10) + "s"
+	}
+	return q + " NAME " + quoteIdent(rp)
+}
+
+func quoteIdent(s string) string {
+	return `"` + strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+// CreateDatabase runs the CREATE DATABASE statement of autocreate.
+func (hb *HttpBackend) CreateDatabase() (err error) {
+	if hb.create_db == "" {
+		return ErrNotFound
+	}
+	q := url.Values{}
+	q.Set("q", hb.create_db)
+	resp, err := hb.client.PostForm(hb.URL+"/query", q)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	respbuf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	var body struct {
+		Error   string `json:"error"`
+		Results []struct {
+			Error string `json:"error"`
+		} `json:"results"`
+	}
+	json.Unmarshal(respbuf, &body)
+	if body.Error != "" {
+		return errors.New(body.Error)
+	}
+	for _, result := range body.Results {
+		if result.Error != "" {
+			return errors.New(result.Error)
+		}
+	}
+	if resp.StatusCode != 200 {
+		return ErrUnknown
+	}
 	return
 }
 
-func (hb *HttpBackend) WriteCompressed(p []byte) (err error) {
-	buf := bytes.NewBuffer(p)
-	err = hb.WriteStream(buf, true)
+// WriteStream writes to db of backend, with precision, rp and consistency
+// in params.
+func (hb *HttpBackend) WriteStream(stream io.Reader, compressed bool, params WriteParams) (err error) {
+	_, err = hb.writeStream(stream, compressed, params)
 	return
 }
 
-func (hb *HttpBackend) WriteStream(stream io.Reader, compressed bool) (err error) {
-	q := url.Values{}
+// reason is the error in response, like {"error":"..."} of influxdb.
+func (hb *HttpBackend) writeStream(stream io.Reader, compressed bool, params WriteParams) (reason string, err error) {
+	q := params.Values()
 	q.Set("db", hb.DB)
 
 	req, err := http.NewRequest("POST", hb.URL+"/write?"+q.Encode(), stream)
@@ -214,6 +312,14 @@ func (hb *HttpBackend) WriteStream(stream io.Reader, compressed bool) (err error
 	}
 	log.Printf("error response: %s\n", respbuf)
 
+	var body struct {
+		Error string `json:"error"`
+	}
+	reason = strings.TrimSpace(string(respbuf))
+	if json.Unmarshal(respbuf, &body) == nil && body.Error != "" {
+		reason = body.Error
+	}
+
 	// translate code to error
 	// https://docs.influxdata.com/influxdb/v1.1/tools/api/#write
 	switch resp.StatusCode {
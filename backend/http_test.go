@@ -10,7 +10,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync"
 	"testing"
+	"time"
 )
 
 func HandlerAny(w http.ResponseWriter, req *http.Request) {
@@ -26,12 +28,12 @@ func CreateTestBackendConfig(dbname string) (cfg *BackendConfig, ts *httptest.Se
 	cfg = &BackendConfig{
 		URL:             ts.URL,
 		DB:              dbname,
-		Interval:        200,
-		Timeout:         4000,
-		TimeoutQuery:    6000,
+		Interval:        200 * time.Millisecond,
+		Timeout:         4 * time.Second,
+		TimeoutQuery:    6 * time.Second,
 		MaxRowLimit:     1000,
-		CheckInterval:   1000,
-		RewriteInterval: 1000,
+		CheckInterval:   time.Second,
+		RewriteInterval: time.Second,
 	}
 	return
 }
@@ -42,7 +44,7 @@ func TestHttpBackendWrite(t *testing.T) {
 	hb := NewHttpBackend(cfg)
 	defer hb.Close()
 
-	err := hb.Write([]byte("cpu,host=server01,region=uswest value=1 1434055562000000000\ncpu value=3,value2=4 1434055562000010000"))
+	err := hb.Write([]byte("cpu,host=server01,region=uswest value=1 1434055562000000000\ncpu value=3,value2=4 1434055562000010000"), WriteParams{})
 	if err != nil {
 		t.Errorf("error: %s", err)
 		return
@@ -63,7 +65,7 @@ func TestHttpBackendWriteCompressed(t *testing.T) {
 		return
 	}
 	p = buf.Bytes()
-	err = hb.WriteCompressed(p)
+	err = hb.WriteCompressed(p, WriteParams{})
 	if err != nil {
 		t.Errorf("error: %s", err)
 		return
@@ -142,3 +144,69 @@ func TestHttpBackendQuery(t *testing.T) {
 		return
 	}
 }
+
+func TestCreateDatabaseQuery(t *testing.T) {
+	tests := []struct {
+		rp       string
+		duration time.Duration
+		q        string
+	}{
+		{q: `CREATE DATABASE "my\"db"`},
+		{rp: "forever", q: `CREATE DATABASE "my\"db" WITH NAME "forever"`},
+		{rp: "week", duration: 7 * 24 * time.Hour, q: `CREATE DATABASE "my\"db" WITH DURATION 604800s NAME "week"`},
+	}
+	for _, tt := range tests {
+		if q := CreateDatabaseQuery(`my"db`, tt.rp, tt.duration); q != tt.q {
+			t.Errorf("query wrong: %s", q)
+		}
+	}
+}
+
+func TestHttpBackendAutoCreate(t *testing.T) {
+	var lock sync.Mutex
+	created := false
+	var queries []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch req.URL.Path {
+		case "/query":
+			req.ParseForm()
+			queries = append(queries, req.Form.Get("q"))
+			created = true
+			w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+		case "/write":
+			if !created {
+				w.WriteHeader(404)
+				w.Write([]byte(`{"error":"database not found: \"auto\""}`))
+				return
+			}
+			w.WriteHeader(204)
+		default:
+			w.WriteHeader(204)
+		}
+	}))
+	defer ts.Close()
+
+	cfg, _ := CreateTestBackendConfig("auto")
+	cfg.URL = ts.URL
+	hb := NewHttpBackend(cfg)
+	defer hb.Close()
+	if err := hb.Write([]byte("cpu value=1\n"), WriteParams{}); err != ErrNotFound {
+		t.Errorf("database created without autocreate: %v", err)
+	}
+
+	cfg.AutoCreate = true
+	cfg.AutoCreateRP = "week"
+	cfg.AutoCreateDuration = 7 * 24 * time.Hour
+	hb = NewHttpBackend(cfg)
+	defer hb.Close()
+	if err := hb.Write([]byte("cpu value=1\n"), WriteParams{}); err != nil {
+		t.Errorf("error: %s", err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(queries) != 1 || queries[0] != `CREATE DATABASE "auto" WITH DURATION 604800s NAME "week"` {
+		t.Errorf("queries wrong: %v", queries)
+	}
+}
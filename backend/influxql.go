@@ -116,14 +116,7 @@ func ScanToken(data []byte, atEOF bool) (advance int, token []byte, err error) {
 }
 
 func GetMeasurementFromInfluxQL(q string) (m string, err error) {
-	buf := bytes.NewBuffer([]byte(q))
-	scanner := bufio.NewScanner(buf)
-	scanner.Buffer([]byte(q), len(q))
-	scanner.Split(ScanToken)
-	var tokens []string
-	for scanner.Scan() {
-		tokens = append(tokens, scanner.Text())
-	}
+	tokens := scanTokens(q)
 	//fmt.Printf("%v\n", tokens)
 
 	for i := 0; i < len(tokens); i++ {
@@ -170,3 +163,86 @@ func getMeasurement(tokens []string) (m string) {
 	}
 	return
 }
+
+func scanTokens(q string) (tokens []string) {
+	buf := bytes.NewBuffer([]byte(q))
+	scanner := bufio.NewScanner(buf)
+	scanner.Buffer([]byte(q), len(q))
+	scanner.Split(ScanToken)
+	for scanner.Scan() {
+		tokens = append(tokens, scanner.Text())
+	}
+	return
+}
+
+// split "region='eu'" and "='eu'" around the =, but not =~, != and the like.
+func splitEqual(token string) (words []string) {
+	if token == "" || token[0] == '"' || token[0] == '\'' {
+		return []string{token}
+	}
+
+	i := strings.IndexByte(token, '=')
+	if i == -1 || token == "=" {
+		return []string{token}
+	}
+	if i+1 < len(token) && token[i+1] == '~' {
+		return []string{token}
+	}
+	if i > 0 && strings.IndexByte("!<>", token[i-1]) != -1 {
+		return []string{token}
+	}
+
+	if i > 0 {
+		words = append(words, token[:i])
+	}
+	words = append(words, "=")
+	if i+1 < len(token) {
+		words = append(words, token[i+1:])
+	}
+	return
+}
+
+// GetTagsFromInfluxQL gives tags pinned by tag = 'value' in where clause.
+// Nothing is pinned if there is an OR in where.
+func GetTagsFromInfluxQL(q string) (tags map[string]string) {
+	tokens := scanTokens(q)
+
+	var words []string
+	where := false
+loop:
+	for _, token := range tokens {
+		lower := strings.ToLower(token)
+		if !where {
+			where = lower == "where"
+			continue
+		}
+		switch lower {
+		case "group", "order", "limit", "slimit", "offset", "soffset", "fill", "tz":
+			break loop
+		case "or":
+			return nil
+		}
+		if token[0] == '(' && strings.Contains(lower, " or ") {
+			return nil
+		}
+		words = append(words, splitEqual(token)...)
+	}
+
+	for i := 1; i+1 < len(words); i++ {
+		if words[i] != "=" {
+			continue
+		}
+		key, value := words[i-1], words[i+1]
+		if len(value) < 2 || value[0] != '\'' {
+			continue
+		}
+		if key[0] == '"' {
+			key = key[1 : len(key)-1]
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[key] = value[1 : len(value)-1]
+	}
+	return
+}
@@ -4,7 +4,10 @@
 
 package backend
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 // SHOW USERS
 // SHOW SUBSCRIPTIONS
@@ -97,6 +100,28 @@ func checkPoint(t *testing.T, q string, m string) {
 	}
 }
 
+func TestGetTagsFromInfluxQL(t *testing.T) {
+	tests := []struct {
+		q    string
+		tags map[string]string
+	}{
+		{q: "select * from http", tags: nil},
+		{q: "select * from http where region = 'eu'", tags: map[string]string{"region": "eu"}},
+		{q: "select * from http where \"region\"='eu' and host='a' and dc = 'b c' group by time(1m)", tags: map[string]string{"region": "eu", "host": "a", "dc": "b c"}},
+		{q: "SELECT mean(\"value\") FROM \"http\" WHERE \"region\" = 'e\\'u' AND time > now() - 1h GROUP BY \"x\" = 'y'", tags: map[string]string{"region": "e'u"}},
+		{q: "select * from http where region = 'eu' or region = 'us'", tags: nil},
+		{q: "select * from http where region = 'eu' and (host = 'a' or host = 'b')", tags: nil},
+		{q: "select * from http where region =~ /eu/ and host != 'a' and dc <> 'x'", tags: nil},
+		{q: "select * from http where value = 1", tags: nil},
+	}
+	for _, tt := range tests {
+		tags := GetTagsFromInfluxQL(tt.q)
+		if !reflect.DeepEqual(tags, tt.tags) {
+			t.Errorf("%s: tags wrong: %v", tt.q, tags)
+		}
+	}
+}
+
 func BenchmarkInfluxQL(b *testing.B) {
 	q := "SELECT mean(\"value\") FROM \"cpu\" WHERE \"region\" = 'uswest' GROUP BY time(10m) fill(0)"
 	for i := 0; i < b.N; i++ {
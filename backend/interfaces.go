@@ -16,6 +16,6 @@ type BackendAPI interface {
 	IsWriteOnly() (b bool)
 	Ping() (version string, err error)
 	GetZone() (zone string)
-	Write(p []byte) (err error)
+	Write(p []byte, params WriteParams) (err error)
 	Close() (err error)
 }
@@ -0,0 +1,248 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+// errors of lines not in line protocol, worded as influxdb does.
+var (
+	ErrMissingMeasurement = errors.New("missing measurement")
+	ErrMissingTagKey      = errors.New("missing tag key")
+	ErrMissingTagValue    = errors.New("missing tag value")
+	ErrDuplicateTags      = errors.New("duplicate tags")
+	ErrMissingFields      = errors.New("missing fields")
+	ErrMissingFieldKey    = errors.New("missing field key")
+	ErrMissingFieldValue  = errors.New("missing field value")
+	ErrReservedFieldKey   = errors.New("invalid field name: time")
+	ErrInvalidNumber      = errors.New("invalid number")
+	ErrInvalidBoolean     = errors.New("invalid boolean")
+	ErrUnbalancedQuotes   = errors.New("unbalanced quotes")
+	ErrInvalidFieldFormat = errors.New("invalid field format")
+	ErrBadTimestamp       = errors.New("bad timestamp")
+)
+
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Field keeps its value as in line protocol, strings quoted and escaped.
+type Field struct {
+	Key   string
+	Value []byte
+}
+
+// Point is a line of line protocol, names unescaped. Time is as written,
+// nil if the point has none.
+type Point struct {
+	Measurement string
+	Tags        []Tag
+	Fields      []Field
+	Time        []byte
+}
+
+const (
+	measurementEscapes = ", "
+	keyEscapes         = ",= "
+)
+
+// scanName reads an escaped name from buf[i:] till one of stops not
+// escaped. Only escapes of chars in escapes are dropped.
+func scanName(buf []byte, i int, stops string, escapes string) (name string, next int) {
+	var out []byte
+	for ; i < len(buf); i++ {
+		c := buf[i]
+		if c == '\\' && i+1 < len(buf) && bytes.IndexByte([]byte(escapes), buf[i+1]) != -1 {
+			i++
+			out = append(out, buf[i])
+			continue
+		}
+		if bytes.IndexByte([]byte(stops), c) != -1 {
+			break
+		}
+		out = append(out, c)
+	}
+	return string(out), i
+}
+
+// scanFieldValue reads a field value from buf[i:], a quoted string may
+// have commas and spaces in it.
+func scanFieldValue(buf []byte, i int) (value []byte, next int, err error) {
+	start := i
+	if i < len(buf) && buf[i] == '"' {
+		for i++; i < len(buf); i++ {
+			if buf[i] == '\\' {
+				i++
+				continue
+			}
+			if buf[i] == '"' {
+				break
+			}
+		}
+		if i >= len(buf) {
+			return nil, i, ErrUnbalancedQuotes
+		}
+		i++
+		if i < len(buf) && buf[i] != ',' && buf[i] != ' ' {
+			return nil, i, ErrInvalidFieldFormat
+		}
+	} else {
+		for ; i < len(buf) && buf[i] != ',' && buf[i] != ' '; i++ {
+		}
+	}
+	if i == start {
+		return nil, i, ErrMissingFieldValue
+	}
+	return buf[start:i], i, nil
+}
+
+// checkFieldValue tells if value not quoted is a float, an integer like
+// "1i", an unsigned like "1u" or a boolean.
+func checkFieldValue(value []byte) (err error) {
+	switch string(value) {
+	case "t", "T", "true", "True", "TRUE", "f", "F", "false", "False", "FALSE":
+		return nil
+	}
+
+	c := value[0]
+	if c != '-' && c != '+' && c != '.' && (c < '0' || c > '9') {
+		return ErrInvalidBoolean
+	}
+	switch value[len(value)-1] {
+	case 'i':
+		_, err = strconv.ParseInt(string(value[:len(value)-1]), 10, 64)
+	case 'u':
+		_, err = strconv.ParseUint(string(value[:len(value)-1]), 10, 64)
+	default:
+		// no hex, inf or nan, which ParseFloat takes.
+		for _, c := range value {
+			if bytes.IndexByte([]byte("0123456789.eE+-"), c) == -1 {
+				return ErrInvalidNumber
+			}
+		}
+		_, err = strconv.ParseFloat(string(value), 64)
+	}
+	if err != nil {
+		return ErrInvalidNumber
+	}
+	return
+}
+
+// ParsePoint parses a line of line protocol, without trailing newline.
+// Field values and timestamp are checked, so a point parsed is one
+// influxdb takes.
+func ParsePoint(line []byte) (p *Point, err error) {
+	name, i := scanName(line, 0, ", ", measurementEscapes)
+	if name == "" {
+		return nil, ErrMissingMeasurement
+	}
+	p = &Point{Measurement: name}
+
+	for i < len(line) && line[i] == ',' {
+		var tag Tag
+		tag.Key, i = scanName(line, i+1, keyEscapes, keyEscapes)
+		if tag.Key == "" {
+			return nil, ErrMissingTagKey
+		}
+		if i >= len(line) || line[i] != '=' {
+			return nil, ErrMissingTagValue
+		}
+		tag.Value, i = scanName(line, i+1, ", ", keyEscapes)
+		if tag.Value == "" {
+			return nil, ErrMissingTagValue
+		}
+		for _, t := range p.Tags {
+			if t.Key == tag.Key {
+				return nil, ErrDuplicateTags
+			}
+		}
+		p.Tags = append(p.Tags, tag)
+	}
+
+	for ; i < len(line) && line[i] == ' '; i++ {
+	}
+	if i >= len(line) {
+		return nil, ErrMissingFields
+	}
+	for {
+		var field Field
+		field.Key, i = scanName(line, i, keyEscapes, keyEscapes)
+		if field.Key == "" {
+			return nil, ErrMissingFieldKey
+		}
+		if field.Key == "time" {
+			return nil, ErrReservedFieldKey
+		}
+		if i >= len(line) || line[i] != '=' {
+			return nil, ErrMissingFieldValue
+		}
+		field.Value, i, err = scanFieldValue(line, i+1)
+		if err != nil {
+			return nil, err
+		}
+		if field.Value[0] != '"' {
+			err = checkFieldValue(field.Value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		p.Fields = append(p.Fields, field)
+		if i >= len(line) || line[i] != ',' {
+			break
+		}
+		i++
+	}
+
+	for ; i < len(line) && line[i] == ' '; i++ {
+	}
+	if i < len(line) {
+		p.Time = line[i:]
+		_, err = strconv.ParseInt(string(p.Time), 10, 64)
+		if err != nil {
+			return nil, ErrBadTimestamp
+		}
+	}
+	return
+}
+
+func appendEscaped(buf []byte, s string, escapes string) []byte {
+	for i := 0; i < len(s); i++ {
+		if bytes.IndexByte([]byte(escapes), s[i]) != -1 {
+			buf = append(buf, '\\')
+		}
+		buf = append(buf, s[i])
+	}
+	return buf
+}
+
+// Bytes formats p in line protocol, without trailing newline.
+func (p *Point) Bytes() (buf []byte) {
+	buf = appendEscaped(buf, p.Measurement, measurementEscapes)
+	for _, tag := range p.Tags {
+		buf = append(buf, ',')
+		buf = appendEscaped(buf, tag.Key, keyEscapes)
+		buf = append(buf, '=')
+		buf = appendEscaped(buf, tag.Value, keyEscapes)
+	}
+	for i, field := range p.Fields {
+		if i == 0 {
+			buf = append(buf, ' ')
+		} else {
+			buf = append(buf, ',')
+		}
+		buf = appendEscaped(buf, field.Key, keyEscapes)
+		buf = append(buf, '=')
+		buf = append(buf, field.Value...)
+	}
+	if p.Time != nil {
+		buf = append(buf, ' ')
+		buf = append(buf, p.Time...)
+	}
+	return
+}
@@ -0,0 +1,80 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePoint(t *testing.T) {
+	p, err := ParsePoint([]byte(`c\,pu\ x,host=a\ b,re\=gion=e\,u value=1i,msg="a, \"b\" c",ok=t 1000`))
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	want := &Point{
+		Measurement: "c,pu x",
+		Tags:        []Tag{{Key: "host", Value: "a b"}, {Key: "re=gion", Value: "e,u"}},
+		Fields: []Field{
+			{Key: "value", Value: []byte("1i")},
+			{Key: "msg", Value: []byte(`"a, \"b\" c"`)},
+			{Key: "ok", Value: []byte("t")},
+		},
+		Time: []byte("1000"),
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("point wrong: %+v", p)
+	}
+
+	for _, line := range []string{
+		"cpu value=1",
+		"cpu,host=a value=1,load=0.5 1000",
+		`c\,pu\ x,host=a\ b,re\=gion=e\,u value=1i,msg="a, \"b\" c",ok=t 1000`,
+		`cpu,path=C:\dir value=1`,
+	} {
+		p, err = ParsePoint([]byte(line))
+		if err != nil {
+			t.Errorf("%s: %s", line, err)
+			continue
+		}
+		if string(p.Bytes()) != line {
+			t.Errorf("%s: formatted wrong: %s", line, p.Bytes())
+		}
+	}
+
+	tests := []struct {
+		line string
+		err  error
+	}{
+		{line: "cpu", err: ErrMissingFields},
+		{line: ",host=a value=1", err: ErrMissingMeasurement},
+		{line: "cpu,=a value=1", err: ErrMissingTagKey},
+		{line: "cpu,host value=1", err: ErrMissingTagValue},
+		{line: "cpu,host= value=1", err: ErrMissingTagValue},
+		{line: "cpu,host=a,host=b value=1", err: ErrDuplicateTags},
+		{line: "cpu,host=a", err: ErrMissingFields},
+		{line: "cpu =1", err: ErrMissingFieldKey},
+		{line: "cpu value", err: ErrMissingFieldValue},
+		{line: "cpu value=", err: ErrMissingFieldValue},
+		{line: "cpu time=1", err: ErrReservedFieldKey},
+		{line: `cpu msg="abc`, err: ErrUnbalancedQuotes},
+		{line: `cpu msg="a"b`, err: ErrInvalidFieldFormat},
+		{line: "cpu value=1.2.3", err: ErrInvalidNumber},
+		{line: "cpu value=0x10", err: ErrInvalidNumber},
+		{line: "cpu value=1e999", err: ErrInvalidNumber},
+		{line: "cpu value=1.5i", err: ErrInvalidNumber},
+		{line: "cpu value=-1u", err: ErrInvalidNumber},
+		{line: "cpu value=yes", err: ErrInvalidBoolean},
+		{line: "cpu value=NaN", err: ErrInvalidBoolean},
+		{line: "cpu value=1 12ab", err: ErrBadTimestamp},
+		{line: "cpu value=1 1000 2000", err: ErrBadTimestamp},
+		{line: "cpu value=1,load=-.5,n=-3i,u=3u,ok=FALSE,s=\"\" -1000"},
+	}
+	for _, tt := range tests {
+		if _, err = ParsePoint([]byte(tt.line)); err != tt.err {
+			t.Errorf("%s: error wrong: %v", tt.line, err)
+		}
+	}
+}
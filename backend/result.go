@@ -0,0 +1,116 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// LineError is a line rejected at ingest, not sent to any backend.
+type LineError struct {
+	Line []byte
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return "unable to parse '" + string(e.Line) + "': " + e.Err.Error()
+}
+
+// PartialWriteError tells lines rejected and measurements without route
+// in a write, the others in it are written. Like influxdb, it's answered
+// with 400.
+type PartialWriteError struct {
+	Rejected []*LineError
+	Unrouted []string
+	Dropped  int
+}
+
+func (e *PartialWriteError) Error() string {
+	reasons := make([]string, 0, len(e.Rejected)+len(e.Unrouted))
+	for _, le := range e.Rejected {
+		reasons = append(reasons, le.Error())
+	}
+	for _, key := range e.Unrouted {
+		reasons = append(reasons, "measurement '"+key+"' has no route")
+	}
+	return "partial write: " + strings.Join(reasons, "\n") + " dropped=" + strconv.Itoa(e.Dropped)
+}
+
+// WriteResult accounts points of a write request. Filtered are dropped
+// on purpose by filter or rewrite rules. Enqueued are points taken by
+// every backend, by name.
+type WriteResult struct {
+	Accepted        int            `json:"accepted"`
+	Filtered        int            `json:"filtered"`
+	DroppedUnrouted int            `json:"dropped_unrouted"`
+	DroppedInvalid  int            `json:"dropped_invalid"`
+	Failed          int            `json:"failed"`
+	Enqueued        map[string]int `json:"enqueued"`
+
+	rejected []*LineError
+	unrouted []string
+	enqueued map[BackendAPI]int
+	// lines normalized, for nexts.
+	forward *bytes.Buffer
+}
+
+func NewWriteResult() (result *WriteResult) {
+	return &WriteResult{
+		Enqueued: make(map[string]int),
+		enqueued: make(map[BackendAPI]int),
+	}
+}
+
+func (result *WriteResult) reject(line []byte, err error) {
+	result.DroppedInvalid++
+	if len(result.rejected) < MAX_REJECTED {
+		result.rejected = append(result.rejected, &LineError{Line: line, Err: err})
+	}
+}
+
+func (result *WriteResult) unroute(key string) {
+	result.DroppedUnrouted++
+	if len(result.unrouted) >= MAX_REJECTED {
+		return
+	}
+	for _, k := range result.unrouted {
+		if k == key {
+			return
+		}
+	}
+	result.unrouted = append(result.unrouted, key)
+}
+
+func (result *WriteResult) enqueue(b BackendAPI) {
+	result.enqueued[b]++
+}
+
+// name counts of backends enqueued, by their names in backends.
+func (result *WriteResult) name(backends map[string]BackendAPI) {
+	for name, b := range backends {
+		if n, ok := result.enqueued[b]; ok {
+			result.Enqueued[name] = n
+		}
+	}
+}
+
+// Err tells how the write went: nil if no point lost but those filtered,
+// ErrWriteFailed if any point failed to go to backends, worth a retry,
+// or a *PartialWriteError if any point was dropped for the client's fault.
+func (result *WriteResult) Err() (err error) {
+	switch {
+	case result.Failed > 0:
+		return ErrWriteFailed
+	case result.DroppedInvalid > 0 || result.DroppedUnrouted > 0:
+		return &PartialWriteError{
+			Rejected: result.rejected,
+			Unrouted: result.unrouted,
+			Dropped:  result.DroppedInvalid + result.DroppedUnrouted,
+		}
+	}
+	return
+}
@@ -0,0 +1,257 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrIllegalRewrite = errors.New("illegal rewrite rule")
+)
+
+// RewriteConfig is a rewrite rule, r:<name> in config. Measurement is a
+// name, a pattern like "re:^app_(.*)" or "glob:app_*", or "*" for all.
+// Rename may use submatches of a re: pattern, like "svc_$1". Tags are
+// pairs like "host=hostname", renamed from key to value, or added.
+type RewriteConfig struct {
+	Measurement string   `config:"measurement"`
+	DB          string   `config:"db"`
+	Rename      string   `config:"rename"`
+	RenameTags  []string `config:"renametags"`
+	DropTags    []string `config:"droptags"`
+	AddTags     []string `config:"addtags"`
+	DropFields  []string `config:"dropfields"`
+}
+
+// LoadRewriteConfig decodes a rewrite rule definition.
+func LoadRewriteConfig(data map[string]string) (cfg *RewriteConfig, err error) {
+	cfg = &RewriteConfig{}
+	err = SetDefaults(cfg)
+	if err != nil {
+		return
+	}
+	err = LoadStructFromMap(data, cfg)
+	return
+}
+
+// ParseTagPairs parses items like "k=v" into tags, sorted by key.
+func ParseTagPairs(items []string) (tags []Tag, err error) {
+	for _, item := range items {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, ErrIllegalRewrite
+		}
+		tags = append(tags, Tag{Key: kv[0], Value: kv[1]})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Key < tags[j].Key })
+	return
+}
+
+// compileMeasurement gives match function of measurement in a rule, a
+// name, a pattern or "*". re is the regexp of a re: pattern.
+func compileMeasurement(m string) (match func(s string) bool, re *regexp.Regexp, err error) {
+	switch {
+	case m == ROUTE_ANY:
+		return func(s string) bool { return true }, nil, nil
+	case strings.HasPrefix(m, ROUTE_REGEXP):
+		re, err = regexp.Compile(m[len(ROUTE_REGEXP):])
+		if err != nil {
+			return
+		}
+		return re.MatchString, re, nil
+	}
+
+	match, err = CompileRoute(m)
+	if err != nil {
+		return
+	}
+	if match == nil {
+		match = func(s string) bool { return s == m }
+	}
+	return
+}
+
+type RewriteRule struct {
+	ruleCounter // points changed or dropped
+	db          string
+	match       func(s string) bool
+	re          *regexp.Regexp
+	rename      string
+	rename_tags map[string]string
+	drop_tags   map[string]bool
+	add_tags    []Tag
+	drop_fields map[string]bool
+}
+
+func stringSet(l []string) (set map[string]bool) {
+	set = make(map[string]bool, len(l))
+	for _, s := range l {
+		set[s] = true
+	}
+	return
+}
+
+func NewRewriteRule(name string, cfg *RewriteConfig) (rule *RewriteRule, err error) {
+	rule = &RewriteRule{
+		ruleCounter: ruleCounter{name: name},
+		db:          cfg.DB,
+		rename:      cfg.Rename,
+		rename_tags: make(map[string]string),
+		drop_tags:   stringSet(cfg.DropTags),
+		drop_fields: stringSet(cfg.DropFields),
+	}
+
+	if cfg.Measurement == "" {
+		return nil, ErrIllegalRewrite
+	}
+	rule.match, rule.re, err = compileMeasurement(cfg.Measurement)
+	if err != nil {
+		return nil, err
+	}
+
+	renames, err := ParseTagPairs(cfg.RenameTags)
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range renames {
+		rule.rename_tags[tag.Key] = tag.Value
+	}
+	rule.add_tags, err = ParseTagPairs(cfg.AddTags)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// apply rule to p, tell if p changed.
+func (rule *RewriteRule) apply(p *Point) (changed bool) {
+	if rule.rename != "" {
+		name := rule.rename
+		if rule.re != nil {
+			m := rule.re.FindStringSubmatchIndex(p.Measurement)
+			name = string(rule.re.ExpandString(nil, rule.rename, p.Measurement, m))
+		}
+		if name != "" && name != p.Measurement {
+			p.Measurement = name
+			changed = true
+		}
+	}
+
+	if len(rule.rename_tags) > 0 || len(rule.drop_tags) > 0 || len(rule.add_tags) > 0 {
+		tags := make(map[string]string, len(p.Tags)+len(rule.add_tags))
+		for _, tag := range p.Tags {
+			if rule.drop_tags[tag.Key] {
+				changed = true
+				continue
+			}
+			if key, ok := rule.rename_tags[tag.Key]; ok {
+				tag.Key = key
+				changed = true
+			}
+			tags[tag.Key] = tag.Value
+		}
+		for _, tag := range rule.add_tags {
+			if v, ok := tags[tag.Key]; !ok || v != tag.Value {
+				tags[tag.Key] = tag.Value
+				changed = true
+			}
+		}
+		if changed {
+			p.Tags = p.Tags[:0]
+			for key, value := range tags {
+				p.Tags = append(p.Tags, Tag{Key: key, Value: value})
+			}
+			sort.Slice(p.Tags, func(i, j int) bool { return p.Tags[i].Key < p.Tags[j].Key })
+		}
+	}
+
+	if len(rule.drop_fields) > 0 {
+		fields := p.Fields[:0]
+		for _, field := range p.Fields {
+			if rule.drop_fields[field.Key] {
+				changed = true
+				continue
+			}
+			fields = append(fields, field)
+		}
+		p.Fields = fields
+	}
+	return
+}
+
+// Rewriter applies rewrite rules to points in order of their names, each
+// rule to the result of the ones before.
+type Rewriter struct {
+	rules []*RewriteRule
+}
+
+func NewRewriter(cfgs map[string]*RewriteConfig) (rw *Rewriter, err error) {
+	rw = &Rewriter{}
+	for name, cfg := range cfgs {
+		var rule *RewriteRule
+		rule, err = NewRewriteRule(name, cfg)
+		if err != nil {
+			return
+		}
+		rw.rules = append(rw.rules, rule)
+	}
+	sort.Slice(rw.rules, func(i, j int) bool { return rw.rules[i].name < rw.rules[j].name })
+	return
+}
+
+func (rw *Rewriter) counters() (cs ruleCounters) {
+	for _, rule := range rw.rules {
+		cs = append(cs, &rule.ruleCounter)
+	}
+	return
+}
+
+// Inherit counters of rules with the same name from orig, after a reload.
+func (rw *Rewriter) Inherit(orig *Rewriter) {
+	if orig == nil {
+		return
+	}
+	rw.counters().inherit(orig.counters())
+}
+
+func (rw *Rewriter) Len() int {
+	return len(rw.rules)
+}
+
+// Rewrite applies rules to point p written to db, in place. changed
+// tells if p should be formatted again, ok is false if all fields of the
+// point are dropped.
+func (rw *Rewriter) Rewrite(db string, p *Point) (changed bool, ok bool) {
+	for _, rule := range rw.rules {
+		if rule.db != "" && rule.db != db {
+			continue
+		}
+		if !rule.match(p.Measurement) {
+			continue
+		}
+		if !rule.apply(p) {
+			continue
+		}
+		rule.add()
+		changed = true
+		if len(p.Fields) == 0 {
+			return true, false
+		}
+	}
+	return changed, true
+}
+
+func (rw *Rewriter) deltas() (deltas map[string]int64) {
+	return rw.counters().deltas()
+}
+
+// RewriteCounts gives points touched by every rule.
+func (rw *Rewriter) RewriteCounts() (counts map[string]int64) {
+	return rw.counters().counts()
+}
@@ -0,0 +1,76 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+)
+
+func TestRewriter(t *testing.T) {
+	rw, err := NewRewriter(map[string]*RewriteConfig{
+		"10-rename": {Measurement: "cpu_old", Rename: "cpu"},
+		"20-app":    {Measurement: "re:^app_(.*)$", Rename: "svc_$1", AddTags: []string{"team=app"}},
+		"30-tags":   {Measurement: "cpu", RenameTags: []string{"hostname=host"}, DropTags: []string{"pid"}},
+		"40-fields": {Measurement: "glob:svc_*", DropFields: []string{"debug"}},
+		"50-db":     {Measurement: "*", DB: "mydb", AddTags: []string{"dc=eu west"}},
+	})
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	tests := []struct {
+		db   string
+		line string
+		out  string
+	}{
+		{line: "cpu_old,pid=1,hostname=a value=1 1000", out: "cpu,host=a value=1 1000"},
+		{line: "app_api,team=web latency=3,debug=\"x y\"", out: "svc_api,team=app latency=3"},
+		{line: "mem value=1", out: "mem value=1"},
+		{db: "mydb", line: "mem value=1", out: "mem,dc=eu\\ west value=1"},
+		{line: "app_api debug=1", out: ""},
+	}
+	for _, tt := range tests {
+		p, err := ParsePoint([]byte(tt.line))
+		if err != nil {
+			t.Fatalf("%s: %s", tt.line, err)
+		}
+		changed, ok := rw.Rewrite(tt.db, p)
+		if tt.out == "" {
+			if ok {
+				t.Errorf("%s: not dropped: %s", tt.line, p.Bytes())
+			}
+			continue
+		}
+		if !ok || changed != (tt.out != tt.line) || string(p.Bytes()) != tt.out {
+			t.Errorf("%s: rewritten wrong: %s %v", tt.line, p.Bytes(), changed)
+		}
+	}
+
+	counts := rw.RewriteCounts()
+	if counts["10-rename"] != 1 || counts["20-app"] != 2 || counts["30-tags"] != 1 ||
+		counts["40-fields"] != 2 || counts["50-db"] != 1 {
+		t.Errorf("counts wrong: %v", counts)
+	}
+	if deltas := rw.deltas(); deltas["20-app"] != 2 {
+		t.Errorf("deltas wrong: %v", deltas)
+	}
+	if deltas := rw.deltas(); deltas["20-app"] != 0 {
+		t.Errorf("deltas not reset: %v", deltas)
+	}
+
+	reloaded, err := NewRewriter(map[string]*RewriteConfig{"20-app": {Measurement: "app_api", Rename: "api"}})
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	reloaded.Inherit(rw)
+	if reloaded.RewriteCounts()["20-app"] != 2 {
+		t.Errorf("counts not inherited: %v", reloaded.RewriteCounts())
+	}
+
+	_, err = NewRewriter(map[string]*RewriteConfig{"bad": {Measurement: "cpu", RenameTags: []string{"host"}}})
+	if err != ErrIllegalRewrite {
+		t.Errorf("illegal rewrite passed: %v", err)
+	}
+}
@@ -0,0 +1,465 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// route keys with these prefixes are patterns, others are names.
+// A name followed by tags like "http,region=eu" is a tag route. Any of
+// them may be only for a database, like "db:mydb/cpu", "db:mydb/re:^app_".
+const (
+	ROUTE_REGEXP = "re:"
+	ROUTE_GLOB   = "glob:"
+	ROUTE_DB     = "db:"
+	// catch-all, for measurements no other route matches.
+	ROUTE_ANY = "*"
+)
+
+var (
+	ErrIllegalRoute = errors.New("illegal route")
+)
+
+// Router maps a measurement to backends. A route matches by, in order:
+// tag routes of the measurement, exact name, the first pattern in
+// lexical order of keys, then the longest name which is a prefix of
+// measurement. A tag route matches a point of exactly the measurement
+// having all its tags, the one with most tags wins. Routes of a database
+// are tried instead of routes for all databases, then its catch-all route
+// "*", the catch-all route for all databases the last. Names are kept in
+// a trie on bytes, so matching them costs O(len(key)) no matter how many
+// routes there are. Router is not changed after built, a reload builds a
+// new one.
+type Router struct {
+	root      *routeNode
+	patterns  []*routePattern
+	tagRoutes map[string][]*tagRoute // by measurement
+	dbs       map[string]*Router
+	fallback  *Route
+	size      int
+}
+
+type routeNode struct {
+	children map[byte]*routeNode
+	route    *Route
+}
+
+type routePattern struct {
+	key   string
+	match func(s string) bool
+	route *Route
+}
+
+type tagRoute struct {
+	key   string
+	tags  map[string]string
+	route *Route
+}
+
+// Route is where points of a measurement go. Every point goes to all
+// backends, or if sharded, to one replica group by hash of its series.
+type Route struct {
+	backends []BackendAPI
+	groups   [][]BackendAPI
+	ring     *HashRing
+}
+
+func NewRoute(backends []BackendAPI) (route *Route) {
+	return &Route{
+		backends: backends,
+		groups:   [][]BackendAPI{backends},
+	}
+}
+
+// NewShardedRoute makes a route of replica groups, names identify groups
+// on the hash ring.
+func NewShardedRoute(names []string, groups [][]BackendAPI) (route *Route) {
+	route = &Route{
+		groups: groups,
+		ring:   NewHashRing(names, SHARD_VNODES),
+	}
+	for _, group := range groups {
+		route.backends = append(route.backends, group...)
+	}
+	return
+}
+
+// Backends gives all backends of route.
+func (route *Route) Backends() []BackendAPI {
+	return route.backends
+}
+
+// Groups gives replica groups, a query goes to one backend of each.
+func (route *Route) Groups() [][]BackendAPI {
+	return route.groups
+}
+
+func (route *Route) Sharded() bool {
+	return route.ring != nil
+}
+
+// SeriesBackends gives backends a point of series goes to.
+func (route *Route) SeriesBackends(series string) []BackendAPI {
+	if route.ring == nil {
+		return route.backends
+	}
+	return route.groups[route.ring.Get(series)]
+}
+
+func NewRouter() (r *Router) {
+	return &Router{
+		root:      &routeNode{},
+		tagRoutes: make(map[string][]*tagRoute),
+		dbs:       make(map[string]*Router),
+	}
+}
+
+// SplitRouteDB splits "db:mydb/key" into db and key, db is "" for routes
+// of all databases. A name with '/' but not the prefix is just a name.
+func SplitRouteDB(key string) (db string, rkey string) {
+	if !strings.HasPrefix(key, ROUTE_DB) {
+		return "", key
+	}
+	i := strings.IndexByte(key, '/')
+	if i == -1 {
+		return "", ""
+	}
+	return key[len(ROUTE_DB):i], key[i+1:]
+}
+
+// RouteDBKey is the route key of key only for database db.
+func RouteDBKey(db string, key string) string {
+	if db == "" {
+		return key
+	}
+	return ROUTE_DB + db + "/" + key
+}
+
+func checkRouteDB(key string) (db string, rkey string, err error) {
+	db, rkey = SplitRouteDB(key)
+	if rkey != key && (db == "" || rkey == "") {
+		err = ErrIllegalRoute
+	}
+	return
+}
+
+// CheckRoute tells if key is a legal route.
+func CheckRoute(key string) (err error) {
+	_, key, err = checkRouteDB(key)
+	if err != nil {
+		return
+	}
+
+	_, err = CompileRoute(key)
+	if err != nil {
+		return
+	}
+	_, _, err = ParseTagRoute(key)
+	return
+}
+
+// ParseTagRoute splits a tag route key into measurement and tags, tags
+// is nil if key is not a tag route.
+func ParseTagRoute(key string) (m string, tags map[string]string, err error) {
+	if strings.HasPrefix(key, ROUTE_REGEXP) || strings.HasPrefix(key, ROUTE_GLOB) {
+		return key, nil, nil
+	}
+
+	items := strings.Split(key, ",")
+	m = items[0]
+	if len(items) == 1 {
+		return
+	}
+	if m == "" {
+		return "", nil, ErrIllegalRoute
+	}
+
+	tags = make(map[string]string, len(items)-1)
+	for _, item := range items[1:] {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return "", nil, ErrIllegalRoute
+		}
+		tags[kv[0]] = kv[1]
+	}
+	return
+}
+
+// CompileRoute gives the match function of a pattern route key, nil if
+// key is a name.
+func CompileRoute(key string) (match func(s string) bool, err error) {
+	switch {
+	case strings.HasPrefix(key, ROUTE_REGEXP):
+		var re *regexp.Regexp
+		re, err = regexp.Compile(key[len(ROUTE_REGEXP):])
+		if err != nil {
+			return
+		}
+		return re.MatchString, nil
+	case strings.HasPrefix(key, ROUTE_GLOB):
+		pattern := key[len(ROUTE_GLOB):]
+		_, err = path.Match(pattern, "")
+		if err != nil {
+			return
+		}
+		return func(s string) bool {
+			ok, _ := path.Match(pattern, s)
+			return ok
+		}, nil
+	}
+	return
+}
+
+// Add sets route of key, replacing the old one if exists.
+func (r *Router) Add(key string, route *Route) (err error) {
+	db, key, err := checkRouteDB(key)
+	if err != nil {
+		return
+	}
+	if db != "" {
+		sub, ok := r.dbs[db]
+		if !ok {
+			sub = NewRouter()
+			r.dbs[db] = sub
+		}
+		size := sub.size
+		err = sub.add(key, route)
+		r.size += sub.size - size
+		return
+	}
+	return r.add(key, route)
+}
+
+func (r *Router) add(key string, route *Route) (err error) {
+	if key == ROUTE_ANY {
+		if r.fallback == nil {
+			r.size++
+		}
+		r.fallback = route
+		return
+	}
+
+	match, err := CompileRoute(key)
+	if err != nil {
+		return
+	}
+	if match != nil {
+		r.addPattern(&routePattern{key: key, match: match, route: route})
+		return
+	}
+
+	m, tags, err := ParseTagRoute(key)
+	if err != nil {
+		return
+	}
+	if tags != nil {
+		r.addTagRoute(m, &tagRoute{key: key, tags: tags, route: route})
+		return
+	}
+
+	node := r.root
+	for i := 0; i < len(key); i++ {
+		if node.children == nil {
+			node.children = make(map[byte]*routeNode)
+		}
+		child, ok := node.children[key[i]]
+		if !ok {
+			child = &routeNode{}
+			node.children[key[i]] = child
+		}
+		node = child
+	}
+	if node.route == nil {
+		r.size++
+	}
+	node.route = route
+	return
+}
+
+func (r *Router) addPattern(rp *routePattern) {
+	i := sort.Search(len(r.patterns), func(i int) bool {
+		return r.patterns[i].key >= rp.key
+	})
+	if i < len(r.patterns) && r.patterns[i].key == rp.key {
+		r.patterns[i] = rp
+		return
+	}
+	r.patterns = append(r.patterns, nil)
+	copy(r.patterns[i+1:], r.patterns[i:])
+	r.patterns[i] = rp
+	r.size++
+}
+
+func (r *Router) addTagRoute(m string, tr *tagRoute) {
+	routes := r.tagRoutes[m]
+	for i, orig := range routes {
+		if orig.key == tr.key {
+			routes[i] = tr
+			return
+		}
+	}
+
+	routes = append(routes, tr)
+	sort.Slice(routes, func(i, j int) bool {
+		if len(routes[i].tags) != len(routes[j].tags) {
+			return len(routes[i].tags) > len(routes[j].tags)
+		}
+		return routes[i].key < routes[j].key
+	})
+	r.tagRoutes[m] = routes
+	r.size++
+}
+
+// HasDB tells if there are routes for database db.
+func (r *Router) HasDB(db string) bool {
+	_, ok := r.dbs[db]
+	return ok
+}
+
+// HasTagRoutes tells if tags of key's points in db are needed to match them.
+func (r *Router) HasTagRoutes(db string, key string) bool {
+	if sub, ok := r.dbs[db]; ok {
+		return sub.HasTagRoutes("", key)
+	}
+	return len(r.tagRoutes[key]) > 0
+}
+
+// MatchSeries finds route of a point in db, by key and its tags. A db
+// with routes of its own never takes routes for all databases, but the
+// catch-all one, so its points don't leak into backends of others.
+func (r *Router) MatchSeries(db string, key string, tags map[string]string) (route *Route, ok bool) {
+	if sub := r.dbs[db]; sub != nil {
+		route, ok = sub.matchSeries(key, tags)
+		if ok {
+			return
+		}
+		if sub.fallback != nil {
+			return sub.fallback, true
+		}
+	} else {
+		route, ok = r.matchSeries(key, tags)
+		if ok {
+			return
+		}
+	}
+
+	if r.fallback != nil {
+		return r.fallback, true
+	}
+	return
+}
+
+// IsFallback tells if route is a catch-all route for db.
+func (r *Router) IsFallback(db string, route *Route) bool {
+	if route == nil {
+		return false
+	}
+	if sub := r.dbs[db]; sub != nil && sub.fallback == route {
+		return true
+	}
+	return r.fallback == route
+}
+
+func (r *Router) matchSeries(key string, tags map[string]string) (route *Route, ok bool) {
+	for _, tr := range r.tagRoutes[key] {
+		if matchTags(tr.tags, tags) {
+			return tr.route, true
+		}
+	}
+	return r.match(key)
+}
+
+// MatchQuery finds routes a query of key in db needs, by tags pinned in
+// it. Points of key may be in any tag route the tags don't contradict,
+// and in the route for key without tags, unless a tag route has all
+// tags of the query.
+func (r *Router) MatchQuery(db string, key string, tags map[string]string) (routes []*Route, ok bool) {
+	rt := r
+	if sub := r.dbs[db]; sub != nil {
+		rt = sub
+	}
+
+	pinned := false
+	for _, tr := range rt.tagRoutes[key] {
+		if contradictTags(tr.tags, tags) {
+			continue
+		}
+		routes = append(routes, tr.route)
+		pinned = pinned || matchTags(tr.tags, tags)
+	}
+	if !pinned {
+		if route, ok := r.MatchSeries(db, key, nil); ok {
+			routes = append(routes, route)
+		}
+	}
+	return routes, len(routes) > 0
+}
+
+// a tag in want has another value in tags.
+func contradictTags(want map[string]string, tags map[string]string) bool {
+	for k, v := range want {
+		if tv, ok := tags[k]; ok && tv != v {
+			return true
+		}
+	}
+	return false
+}
+
+func matchTags(want map[string]string, tags map[string]string) bool {
+	for k, v := range want {
+		if tv, ok := tags[k]; !ok || tv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Match finds route of key without tags, in routes for all databases.
+func (r *Router) Match(key string) (route *Route, ok bool) {
+	return r.MatchSeries("", key, nil)
+}
+
+func (r *Router) match(key string) (route *Route, ok bool) {
+	var exact bool
+	route, ok, exact = r.matchName(key)
+	if exact {
+		return
+	}
+
+	for _, rp := range r.patterns {
+		if rp.match(key) {
+			return rp.route, true
+		}
+	}
+	return
+}
+
+// longest name which is a prefix of key, exact if it's key itself.
+func (r *Router) matchName(key string) (route *Route, ok bool, exact bool) {
+	node := r.root
+	for i := 0; ; i++ {
+		if node.route != nil {
+			route, ok = node.route, true
+		}
+		if i == len(key) {
+			exact = node.route != nil
+			return
+		}
+		node = node.children[key[i]]
+		if node == nil {
+			return
+		}
+	}
+}
+
+// Len is the number of routes.
+func (r *Router) Len() int {
+	return r.size
+}
@@ -0,0 +1,319 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"testing"
+)
+
+func matchRoute(route *Route, b BackendAPI) bool {
+	backends := route.Backends()
+	return len(backends) == 1 && backends[0] == b
+}
+
+func TestRouter(t *testing.T) {
+	bs := make(map[string]BackendAPI)
+	router := NewRouter()
+	for _, key := range []string{"cpu", "cpu.lo", "cpu.load", "mem", "c"} {
+		bs[key] = &Backends{name: key}
+		router.Add(key, NewRoute([]BackendAPI{bs[key]}))
+	}
+	if router.Len() != 5 {
+		t.Errorf("router len wrong: %d", router.Len())
+	}
+
+	tests := []struct {
+		key   string
+		route string
+	}{
+		{key: "cpu", route: "cpu"},
+		{key: "cpu.load", route: "cpu.load"},
+		{key: "cpu.load1", route: "cpu.load"},
+		{key: "cpu.lo", route: "cpu.lo"},
+		{key: "cpu.low", route: "cpu.lo"},
+		{key: "cpu.l", route: "cpu"},
+		{key: "cpux", route: "cpu"},
+		{key: "cp", route: "c"},
+		{key: "memory", route: "mem"},
+		{key: "me", route: ""},
+		{key: "disk", route: ""},
+		{key: "", route: ""},
+	}
+	// map order changes between runs, go over a few times.
+	for i := 0; i < 10; i++ {
+		for _, tt := range tests {
+			route, ok := router.Match(tt.key)
+			if tt.route == "" {
+				if ok {
+					t.Errorf("%s matched: %v", tt.key, route)
+				}
+				continue
+			}
+			if !ok || !matchRoute(route, bs[tt.route]) {
+				t.Errorf("%s should match %s: %v", tt.key, tt.route, route)
+			}
+		}
+	}
+
+	// replace a route.
+	router.Add("cpu", NewRoute([]BackendAPI{bs["mem"]}))
+	route, ok := router.Match("cpu.l")
+	if !ok || !matchRoute(route, bs["mem"]) || router.Len() != 5 {
+		t.Errorf("route not replaced: %v", route)
+	}
+}
+
+func TestRouterPatterns(t *testing.T) {
+	bs := make(map[string]BackendAPI)
+	router := NewRouter()
+	for _, key := range []string{
+		"app",
+		"app_api_latency",
+		"re:^app_(api|web)_.*",
+		"glob:app_*_errors",
+		"glob:*.count",
+	} {
+		bs[key] = &Backends{name: key}
+		err := router.Add(key, NewRoute([]BackendAPI{bs[key]}))
+		if err != nil {
+			t.Fatalf("error: %s", err)
+		}
+	}
+	if router.Len() != 5 {
+		t.Errorf("router len wrong: %d", router.Len())
+	}
+
+	tests := []struct {
+		key   string
+		route string
+	}{
+		// exact first.
+		{key: "app_api_latency", route: "app_api_latency"},
+		// glob: before re: in lexical order.
+		{key: "app_web_errors", route: "glob:app_*_errors"},
+		{key: "app_web_requests", route: "re:^app_(api|web)_.*"},
+		// patterns before prefix.
+		{key: "app_api_latency_p99", route: "re:^app_(api|web)_.*"},
+		{key: "cpu.count", route: "glob:*.count"},
+		{key: "app_db_requests", route: "app"},
+		{key: "cpu", route: ""},
+	}
+	for _, tt := range tests {
+		route, ok := router.Match(tt.key)
+		if tt.route == "" {
+			if ok {
+				t.Errorf("%s matched: %v", tt.key, route)
+			}
+			continue
+		}
+		if !ok || !matchRoute(route, bs[tt.route]) {
+			t.Errorf("%s should match %s: %v", tt.key, tt.route, route)
+		}
+	}
+
+	for _, key := range []string{"re:app_(", "glob:app_[", "glob:["} {
+		if router.Add(key, nil) == nil {
+			t.Errorf("illegal pattern added: %s", key)
+		}
+	}
+}
+
+func TestRouterTags(t *testing.T) {
+	bs := make(map[string]BackendAPI)
+	router := NewRouter()
+	for _, key := range []string{
+		"http",
+		"http,region=eu",
+		"http,region=eu,tier=web",
+		"http,dc=a",
+		"httpd",
+	} {
+		bs[key] = &Backends{name: key}
+		err := router.Add(key, NewRoute([]BackendAPI{bs[key]}))
+		if err != nil {
+			t.Fatalf("error: %s", err)
+		}
+	}
+	if !router.HasTagRoutes("", "http") || router.HasTagRoutes("", "httpd") {
+		t.Errorf("tag routes wrong")
+	}
+
+	tests := []struct {
+		key   string
+		tags  map[string]string
+		route string
+	}{
+		{key: "http", tags: nil, route: "http"},
+		{key: "http", tags: map[string]string{"region": "us"}, route: "http"},
+		{key: "http", tags: map[string]string{"region": "eu"}, route: "http,region=eu"},
+		{key: "http", tags: map[string]string{"region": "eu", "tier": "web"}, route: "http,region=eu,tier=web"},
+		// same number of tags, lexical order.
+		{key: "http", tags: map[string]string{"region": "eu", "dc": "a"}, route: "http,dc=a"},
+		// tag routes are for exactly the measurement.
+		{key: "httpd", tags: map[string]string{"region": "eu"}, route: "httpd"},
+		{key: "https", tags: map[string]string{"region": "eu"}, route: "http"},
+	}
+	for _, tt := range tests {
+		route, ok := router.MatchSeries("", tt.key, tt.tags)
+		if !ok || !matchRoute(route, bs[tt.route]) {
+			t.Errorf("%s %v should match %s: %v", tt.key, tt.tags, tt.route, route)
+		}
+	}
+
+	queries := []struct {
+		tags   map[string]string
+		routes []string
+	}{
+		// not pinned, every route points may be in.
+		{tags: nil, routes: []string{"http,region=eu,tier=web", "http,dc=a", "http,region=eu", "http"}},
+		{tags: map[string]string{"region": "us"}, routes: []string{"http,dc=a", "http"}},
+		// more tags may go to another route.
+		{tags: map[string]string{"region": "eu"}, routes: []string{"http,region=eu,tier=web", "http,dc=a", "http,region=eu"}},
+		{tags: map[string]string{"region": "eu", "tier": "web", "dc": "b"}, routes: []string{"http,region=eu,tier=web", "http,region=eu"}},
+	}
+	for _, tt := range queries {
+		routes, ok := router.MatchQuery("", "http", tt.tags)
+		if !ok || len(routes) != len(tt.routes) {
+			t.Errorf("%v should match %v: %v", tt.tags, tt.routes, routes)
+			continue
+		}
+		for i, route := range routes {
+			if !matchRoute(route, bs[tt.routes[i]]) {
+				t.Errorf("%v should match %v: %v", tt.tags, tt.routes, routes)
+			}
+		}
+	}
+	if _, ok := router.MatchQuery("", "mem", nil); ok {
+		t.Errorf("query of unknown measurement matched")
+	}
+
+	for _, key := range []string{"http,region", "http,=eu", ",region=eu"} {
+		if CheckRoute(key) == nil {
+			t.Errorf("illegal route passed: %s", key)
+		}
+	}
+	if CheckRoute("re:^a{1,3},b") != nil {
+		t.Errorf("comma in regexp route failed")
+	}
+}
+
+func TestRouterDB(t *testing.T) {
+	bs := make(map[string]BackendAPI)
+	router := NewRouter()
+	for _, key := range []string{
+		"cpu",
+		"mem",
+		"db:mydb/cpu",
+		"db:mydb/re:^app_",
+		"db:other/http,region=eu",
+		"db:other/a/b",
+		"net/in",
+	} {
+		bs[key] = &Backends{name: key}
+		err := router.Add(key, NewRoute([]BackendAPI{bs[key]}))
+		if err != nil {
+			t.Fatalf("error: %s", err)
+		}
+	}
+	if router.Len() != 7 || !router.HasDB("mydb") || router.HasDB("cpu") || router.HasDB("net") {
+		t.Errorf("router wrong: %d", router.Len())
+	}
+	if !router.HasTagRoutes("other", "http") || router.HasTagRoutes("mydb", "http") {
+		t.Errorf("tag routes wrong")
+	}
+
+	tests := []struct {
+		db    string
+		key   string
+		tags  map[string]string
+		route string
+	}{
+		{db: "", key: "cpu", route: "cpu"},
+		{db: "mydb", key: "cpu.load", route: "db:mydb/cpu"},
+		{db: "mydb", key: "app_api", route: "db:mydb/re:^app_"},
+		// routes for all databases not for a database with its own.
+		{db: "mydb", key: "mem", route: ""},
+		{db: "other", key: "cpu", route: ""},
+		{db: "nodb", key: "cpu", route: "cpu"},
+		{db: "", key: "net/in", route: "net/in"},
+		{db: "other", key: "http", tags: map[string]string{"region": "eu"}, route: "db:other/http,region=eu"},
+		{db: "other", key: "a/b", route: "db:other/a/b"},
+		{db: "", key: "app_api", route: ""},
+		{db: "", key: "http", tags: map[string]string{"region": "eu"}, route: ""},
+	}
+	for _, tt := range tests {
+		route, ok := router.MatchSeries(tt.db, tt.key, tt.tags)
+		if tt.route == "" {
+			if ok {
+				t.Errorf("%s/%s matched: %v", tt.db, tt.key, route)
+			}
+			continue
+		}
+		if !ok || !matchRoute(route, bs[tt.route]) {
+			t.Errorf("%s/%s should match %s: %v", tt.db, tt.key, tt.route, route)
+		}
+	}
+
+	for _, key := range []string{"db:mydb", "db:/cpu", "db:mydb/", "db:mydb/re:(", "db:mydb/http,region"} {
+		if router.Add(key, NewRoute(nil)) == nil {
+			t.Errorf("illegal route added: %s", key)
+		}
+		if CheckRoute(key) == nil {
+			t.Errorf("illegal route passed: %s", key)
+		}
+	}
+}
+
+func TestRouterFallback(t *testing.T) {
+	bs := make(map[string]BackendAPI)
+	router := NewRouter()
+	for _, key := range []string{"cpu", "*", "db:mydb/re:^app_", "db:mydb/*", "db:app/mem"} {
+		bs[key] = &Backends{name: key}
+		err := router.Add(key, NewRoute([]BackendAPI{bs[key]}))
+		if err != nil {
+			t.Fatalf("error: %s", err)
+		}
+	}
+	if router.Len() != 5 {
+		t.Errorf("router wrong: %d", router.Len())
+	}
+
+	tests := []struct {
+		db       string
+		key      string
+		route    string
+		fallback bool
+	}{
+		{db: "", key: "cpu", route: "cpu"},
+		{db: "", key: "mem", route: "*", fallback: true},
+		{db: "mydb", key: "app_api", route: "db:mydb/re:^app_"},
+		// catch-all of db, not routes for all databases.
+		{db: "mydb", key: "cpu", route: "db:mydb/*", fallback: true},
+		{db: "mydb", key: "mem", route: "db:mydb/*", fallback: true},
+		{db: "other", key: "mem", route: "*", fallback: true},
+		{db: "app", key: "cpu", route: "*", fallback: true},
+	}
+	for _, tt := range tests {
+		route, ok := router.MatchSeries(tt.db, tt.key, nil)
+		if !ok || !matchRoute(route, bs[tt.route]) {
+			t.Errorf("%s/%s should match %s: %v", tt.db, tt.key, tt.route, route)
+		}
+		if router.IsFallback(tt.db, route) != tt.fallback {
+			t.Errorf("%s/%s fallback wrong", tt.db, tt.key)
+		}
+	}
+}
+
+func BenchmarkRouterMatch(b *testing.B) {
+	router := NewRouter()
+	for i := 0; i < 1000; i++ {
+		router.Add(fmt.Sprintf("app_%d_", i), NewRoute(nil))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		router.Match("app_999_requests_total")
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// virtual nodes of every group on the ring.
+const SHARD_VNODES = 160
+
+var (
+	ErrQueryFailed    = errors.New("query error")
+	ErrChunkedShard   = errors.New("chunked query on sharded measurement")
+	ErrAggregateShard = errors.New("aggregation or group by time on measurement in several groups of backends, results of groups can't be merged")
+	ErrLimitShard     = errors.New("limit or offset on measurement in several groups of backends, results of groups can't be merged")
+	ErrOrderShard     = errors.New("order by time desc on measurement in several groups of backends, results of groups can't be merged")
+	ErrOverlapRoutes  = errors.New("query over routes sharing backends, points would be merged twice")
+)
+
+var (
+	shardQuoted = regexp.MustCompile(`'(?:[^'\\]|\\.)*'|"(?:[^"\\]|\\.)*"`)
+	shardCall   = regexp.MustCompile(`\b([a-z_]+)\s*\(`)
+	shardLimit  = regexp.MustCompile(`(?i)\b(limit|slimit|offset|soffset)\b`)
+	shardOrder  = regexp.MustCompile(`(?i)\border\s+by\s+time\s+desc\b`)
+)
+
+// words followed by a paren but not calls of a function to merge.
+var shardNoCall = map[string]bool{
+	"now": true, "where": true, "and": true, "or": true,
+	"from": true, "select": true, "by": true,
+}
+
+// CheckShardQuery tells if results of q from every group of a sharded
+// measurement can be merged, by joining series and sorting by time. Any
+// function call, like an aggregation or group by time(), limits and
+// descending order can't.
+func CheckShardQuery(q string) (err error) {
+	// names and strings quoted may be anything.
+	q = strings.ToLower(shardQuoted.ReplaceAllString(q, `""`))
+	for _, m := range shardCall.FindAllStringSubmatch(q, -1) {
+		if !shardNoCall[m[1]] {
+			return ErrAggregateShard
+		}
+	}
+	switch {
+	case shardLimit.MatchString(q):
+		return ErrLimitShard
+	case shardOrder.MatchString(q):
+		return ErrOrderShard
+	}
+	return
+}
+
+// RouteGroups gives groups of backends to query for routes, identical
+// groups once. Groups sharing only some backends would give points twice.
+func RouteGroups(routes []*Route) (groups [][]BackendAPI, err error) {
+	owner := make(map[BackendAPI]int)
+	for _, route := range routes {
+	next:
+		for _, group := range route.Groups() {
+			if i, ok := owner[group[0]]; ok && len(groups[i]) == len(group) {
+				for _, b := range group {
+					if j, ok := owner[b]; !ok || j != i {
+						return nil, ErrOverlapRoutes
+					}
+				}
+				continue next
+			}
+			for _, b := range group {
+				if _, ok := owner[b]; ok {
+					return nil, ErrOverlapRoutes
+				}
+				owner[b] = len(groups)
+			}
+			groups = append(groups, group)
+		}
+	}
+	return
+}
+
+// SplitGroups splits backends of a measurement into replica groups. It
+// is sharded if any item has a comma, then every item is a group, like
+// ["a,b", "c,d"]. A trailing comma makes a single group sharded, like
+// ["a,", "b"]. Otherwise all backends are one group.
+func SplitGroups(bs_names []string) (groups [][]string, sharded bool) {
+	for _, item := range bs_names {
+		if strings.IndexByte(item, ',') != -1 {
+			sharded = true
+			break
+		}
+	}
+	if !sharded {
+		return [][]string{bs_names}, false
+	}
+
+	for _, item := range bs_names {
+		groups = append(groups, SplitList(item))
+	}
+	return
+}
+
+// HashRing assigns keys to groups by consistent hashing, adding or
+// removing a group only moves keys from or to it.
+type HashRing struct {
+	hashes []uint32
+	owners []int
+}
+
+// NewHashRing puts vnodes points of every group on the ring, by names.
+func NewHashRing(names []string, vnodes int) (hr *HashRing) {
+	type point struct {
+		hash  uint32
+		owner int
+	}
+	points := make([]point, 0, len(names)*vnodes)
+	for i, name := range names {
+		for v := 0; v < vnodes; v++ {
+			h := crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s#%d", name, v)))
+			points = append(points, point{hash: h, owner: i})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+
+	hr = &HashRing{
+		hashes: make([]uint32, len(points)),
+		owners: make([]int, len(points)),
+	}
+	for i, p := range points {
+		hr.hashes[i] = p.hash
+		hr.owners[i] = p.owner
+	}
+	return
+}
+
+// Get gives index of the group key belongs to.
+func (hr *HashRing) Get(key string) int {
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(hr.hashes), func(i int) bool { return hr.hashes[i] >= h })
+	if i == len(hr.hashes) {
+		i = 0
+	}
+	return hr.owners[i]
+}
+
+// ScanSeries gives series key of a point, measurement with tags sorted,
+// so a series gets the same key whatever order its tags are in.
+func ScanSeries(pointbuf []byte) (series string, err error) {
+	end := -1
+	var commas []int
+loop:
+	for i := 0; i < len(pointbuf); i++ {
+		switch pointbuf[i] {
+		case '\\':
+			i++
+		case ',':
+			commas = append(commas, i)
+		case ' ':
+			end = i
+			break loop
+		}
+	}
+	if end == -1 {
+		return "", io.EOF
+	}
+	if len(commas) == 0 {
+		return string(pointbuf[:end]), nil
+	}
+
+	tags := make([]string, 0, len(commas))
+	for i, start := range commas {
+		stop := end
+		if i+1 < len(commas) {
+			stop = commas[i+1]
+		}
+		tags = append(tags, string(pointbuf[start+1:stop]))
+	}
+	sort.Strings(tags)
+	return string(pointbuf[:commas[0]]) + "," + strings.Join(tags, ","), nil
+}
+
+// responseBuffer keeps a query response in memory, to be merged.
+type responseBuffer struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{header: make(http.Header), code: 200}
+}
+
+func (rb *responseBuffer) Header() http.Header {
+	return rb.header
+}
+
+func (rb *responseBuffer) Write(p []byte) (int, error) {
+	return rb.body.Write(p)
+}
+
+func (rb *responseBuffer) WriteHeader(code int) {
+	rb.code = code
+}
+
+type querySeries struct {
+	Name    string            `json:"name"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Columns []string          `json:"columns"`
+	Values  [][]interface{}   `json:"values"`
+}
+
+type queryResult struct {
+	StatementID int            `json:"statement_id"`
+	Series      []*querySeries `json:"series,omitempty"`
+	Error       string         `json:"error,omitempty"`
+}
+
+type queryResponse struct {
+	Results []*queryResult `json:"results"`
+	Error   string         `json:"error,omitempty"`
+}
+
+func seriesID(s *querySeries) string {
+	keys := make([]string, 0, len(s.Tags))
+	for k, v := range s.Tags {
+		keys = append(keys, k+"="+v)
+	}
+	sort.Strings(keys)
+	return s.Name + "," + strings.Join(keys, ",")
+}
+
+func lessTime(a, b interface{}) bool {
+	switch x := a.(type) {
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		xi, err1 := x.Int64()
+		yi, err2 := y.Int64()
+		if err1 == nil && err2 == nil {
+			return xi < yi
+		}
+		return x < y
+	case string:
+		y, ok := b.(string)
+		return ok && x < y
+	}
+	return false
+}
+
+// MergeQueryResults merges responses of the same query from every shard.
+// Series of the same name and tags are joined and sorted by time.
+func MergeQueryResults(bodies [][]byte) (p []byte, err error) {
+	merged := &queryResponse{}
+	index := make(map[int]map[string]*querySeries)
+	for _, body := range bodies {
+		resp := &queryResponse{}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		err = dec.Decode(resp)
+		if err != nil {
+			return
+		}
+		if resp.Error != "" {
+			return body, nil
+		}
+
+		for i, result := range resp.Results {
+			if result.Error != "" {
+				return body, nil
+			}
+			if i == len(merged.Results) {
+				merged.Results = append(merged.Results, &queryResult{StatementID: result.StatementID})
+				index[i] = make(map[string]*querySeries)
+			}
+			mr := merged.Results[i]
+			for _, s := range result.Series {
+				id := seriesID(s)
+				ms, ok := index[i][id]
+				if !ok {
+					index[i][id] = s
+					mr.Series = append(mr.Series, s)
+					continue
+				}
+				ms.Values = append(ms.Values, s.Values...)
+			}
+		}
+	}
+
+	for _, result := range merged.Results {
+		for _, s := range result.Series {
+			if len(s.Columns) == 0 || s.Columns[0] != "time" {
+				continue
+			}
+			sort.SliceStable(s.Values, func(i, j int) bool {
+				if len(s.Values[i]) == 0 || len(s.Values[j]) == 0 {
+					return false
+				}
+				return lessTime(s.Values[i][0], s.Values[j][0])
+			})
+		}
+		sort.SliceStable(result.Series, func(i, j int) bool {
+			return seriesID(result.Series[i]) < seriesID(result.Series[j])
+		})
+	}
+	return json.Marshal(merged)
+}
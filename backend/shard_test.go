@@ -0,0 +1,255 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitGroups(t *testing.T) {
+	tests := []struct {
+		bs_names []string
+		groups   [][]string
+		sharded  bool
+	}{
+		{bs_names: []string{"a", "b"}, groups: [][]string{{"a", "b"}}, sharded: false},
+		{bs_names: []string{"a,b", "c, d"}, groups: [][]string{{"a", "b"}, {"c", "d"}}, sharded: true},
+		{bs_names: []string{"a,", "b"}, groups: [][]string{{"a"}, {"b"}}, sharded: true},
+	}
+	for _, tt := range tests {
+		groups, sharded := SplitGroups(tt.bs_names)
+		if sharded != tt.sharded || !reflect.DeepEqual(groups, tt.groups) {
+			t.Errorf("%v: groups wrong: %v %v", tt.bs_names, groups, sharded)
+		}
+	}
+}
+
+func TestHashRing(t *testing.T) {
+	hr := NewHashRing([]string{"a", "b", "c"}, SHARD_VNODES)
+	counts := make([]int, 3)
+	owners := make(map[string]int)
+	for i := 0; i < 30000; i++ {
+		key := fmt.Sprintf("cpu,host=server%d", i)
+		owners[key] = hr.Get(key)
+		counts[owners[key]]++
+	}
+	for i, count := range counts {
+		if count < 6000 || count > 14000 {
+			t.Errorf("group %d unbalanced: %v", i, counts)
+		}
+	}
+
+	// a new group only takes keys from others.
+	hr = NewHashRing([]string{"a", "b", "c", "d"}, SHARD_VNODES)
+	moved := 0
+	for key, owner := range owners {
+		o := hr.Get(key)
+		if o == owner {
+			continue
+		}
+		if o != 3 {
+			t.Fatalf("%s moved from %d to %d", key, owner, o)
+		}
+		moved++
+	}
+	if moved < 4500 || moved > 10500 {
+		t.Errorf("%d keys moved to new group", moved)
+	}
+}
+
+func TestScanSeries(t *testing.T) {
+	tests := []struct {
+		line   string
+		series string
+	}{
+		{line: "cpu value=1", series: "cpu"},
+		{line: "cpu,region=eu,host=a value=1 1000", series: "cpu,host=a,region=eu"},
+		{line: "cpu,host=a,region=eu value=1", series: "cpu,host=a,region=eu"},
+		{line: "c\\,pu,z=x\\,y,a=b\\ c value=1", series: "c\\,pu,a=b\\ c,z=x\\,y"},
+	}
+	for _, tt := range tests {
+		series, err := ScanSeries([]byte(tt.line))
+		if err != nil || series != tt.series {
+			t.Errorf("%s: series wrong: %s %v", tt.line, series, err)
+		}
+	}
+	if _, err := ScanSeries([]byte("cpu")); err == nil {
+		t.Errorf("point without fields passed")
+	}
+}
+
+func TestMergeQueryResults(t *testing.T) {
+	p, err := MergeQueryResults([][]byte{
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"b"},"columns":["time","value"],"values":[[2,1.5]]},{"name":"cpu","columns":["time","value"],"values":[[3,1]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","value"],"values":[[1,2]]},{"name":"cpu","columns":["time","value"],"values":[[1,5]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0}]}`),
+	})
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	want := `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[1,5],[3,1]]},{"name":"cpu","tags":{"host":"a"},"columns":["time","value"],"values":[[1,2]]},{"name":"cpu","tags":{"host":"b"},"columns":["time","value"],"values":[[2,1.5]]}]}]}`
+	if string(p) != want {
+		t.Errorf("merged wrong: %s", p)
+	}
+
+	failed := []byte(`{"results":[{"statement_id":0,"error":"database not found: test"}]}`)
+	p, err = MergeQueryResults([][]byte{[]byte(`{"results":[{"statement_id":0}]}`), failed})
+	if err != nil || string(p) != string(failed) {
+		t.Errorf("error not passed: %s %v", p, err)
+	}
+}
+
+func TestCheckShardQuery(t *testing.T) {
+	tests := []struct {
+		q   string
+		err error
+	}{
+		{q: "select value from cpu where time > now() - 1h", err: nil},
+		{q: "SELECT value FROM cpu WHERE (host = 'a' OR host = 'b') AND time > now() - 1h", err: nil},
+		{q: "select value from cpu where host = 'count(' and time > now() - 1h", err: nil},
+		{q: `select "limit" from cpu where time > now() - 1h order by time asc`, err: nil},
+		{q: "select count(value) from cpu where time > now() - 1h", err: ErrAggregateShard},
+		{q: "select MEAN(value) from cpu where time > now() - 1h", err: ErrAggregateShard},
+		{q: "select sum (value) from cpu where time > now() - 1h group by host", err: ErrAggregateShard},
+		{q: "select value from cpu where time > now() - 1h group by time(1m)", err: ErrAggregateShard},
+		{q: "select value from cpu where time > now() - 1h limit 10", err: ErrLimitShard},
+		{q: "select value from cpu where time > now() - 1h group by * slimit 1 soffset 1", err: ErrLimitShard},
+		{q: "select value from cpu where time > now() - 1h ORDER BY time DESC", err: ErrOrderShard},
+	}
+	for _, tt := range tests {
+		if err := CheckShardQuery(tt.q); err != tt.err {
+			t.Errorf("%s: error wrong: %v", tt.q, err)
+		}
+	}
+}
+
+func TestInfluxClusterShards(t *testing.T) {
+	var bss []BackendAPI
+	var names []string
+	for i := 0; i < 2; i++ {
+		body := fmt.Sprintf(`{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"s%d"},"columns":["time","value"],"values":[[%d,1]]}]}]}`, i, i)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/query" {
+				w.Write([]byte(body))
+				return
+			}
+			w.WriteHeader(204)
+		}))
+		defer ts.Close()
+
+		cfg, _ := CreateTestBackendConfig("shard")
+		cfg.URL = ts.URL
+		hb := NewHttpBackend(cfg)
+		defer hb.Close()
+		bss = append(bss, hb)
+		names = append(names, fmt.Sprintf("s%d", i))
+	}
+
+	ic := NewInfluxCluster(&StaticConfigSource{}, &NodeConfig{})
+	defer ic.Close()
+	route := NewShardedRoute(names, [][]BackendAPI{{bss[0]}, {bss[1]}})
+	ic.router.Add("cpu", route)
+
+	seen := make(map[BackendAPI]bool)
+	for i := 0; i < 100; i++ {
+		series, _ := ScanSeries([]byte(fmt.Sprintf("cpu,host=server%d value=1", i)))
+		bs := route.SeriesBackends(series)
+		if len(bs) != 1 {
+			t.Fatalf("series in %d groups", len(bs))
+		}
+		seen[bs[0]] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("series not sharded")
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost/query?q=select+value+from+cpu+where+time+%3E+now()+-+1h&db=test", nil)
+	w := httptest.NewRecorder()
+	err := ic.Query(w, req)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	want := `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"s0"},"columns":["time","value"],"values":[[0,1]]},{"name":"cpu","tags":{"host":"s1"},"columns":["time","value"],"values":[[1,1]]}]}]}`
+	if w.Code != 200 || w.Body.String() != want {
+		t.Errorf("query wrong: %d %s", w.Code, w.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "http://localhost/query?q=select+value+from+cpu+where+time+%3E+now()+-+1h&db=test&chunked=true", nil)
+	w = httptest.NewRecorder()
+	if ic.Query(w, req) != ErrChunkedShard || w.Code != 400 {
+		t.Errorf("chunked query on shards: %d", w.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "http://localhost/query?q=select+count(value)+from+cpu+where+time+%3E+now()+-+1h&db=test", nil)
+	w = httptest.NewRecorder()
+	if ic.Query(w, req) != ErrAggregateShard || w.Code != 400 || w.Body.String() != ErrAggregateShard.Error() {
+		t.Errorf("aggregation on shards: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRouteGroups(t *testing.T) {
+	a, b, c := &Backends{name: "a"}, &Backends{name: "b"}, &Backends{name: "c"}
+	groups, err := RouteGroups([]*Route{NewRoute([]BackendAPI{a, b}), NewRoute([]BackendAPI{c}), NewRoute([]BackendAPI{b, a})})
+	if err != nil || len(groups) != 2 {
+		t.Errorf("groups wrong: %v %v", groups, err)
+	}
+	if _, err = RouteGroups([]*Route{NewRoute([]BackendAPI{a, b}), NewRoute([]BackendAPI{a})}); err != ErrOverlapRoutes {
+		t.Errorf("overlapped routes passed: %v", err)
+	}
+}
+
+func TestInfluxClusterQueryTagRoutes(t *testing.T) {
+	var bss []BackendAPI
+	for i, region := range []string{"eu", "us"} {
+		body := fmt.Sprintf(`{"results":[{"statement_id":0,"series":[{"name":"http","tags":{"region":"%s"},"columns":["time","value"],"values":[[%d,1]]}]}]}`, region, i)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/query" {
+				w.Write([]byte(body))
+				return
+			}
+			w.WriteHeader(204)
+		}))
+		defer ts.Close()
+
+		cfg, _ := CreateTestBackendConfig("tags")
+		cfg.URL = ts.URL
+		hb := NewHttpBackend(cfg)
+		defer hb.Close()
+		bss = append(bss, hb)
+	}
+
+	ic := NewInfluxCluster(&StaticConfigSource{}, &NodeConfig{})
+	defer ic.Close()
+	ic.router.Add("http,region=eu", NewRoute([]BackendAPI{bss[0]}))
+	ic.router.Add("http", NewRoute([]BackendAPI{bss[1]}))
+
+	// pinned, only the tag route.
+	req, _ := http.NewRequest("GET", "http://localhost/query?q=select+value+from+http+where+region+%3D+'eu'+and+time+%3E+now()+-+1h&db=test", nil)
+	w := httptest.NewRecorder()
+	err := ic.Query(w, req)
+	if err != nil || w.Code != 200 || strings.Contains(w.Body.String(), "us") {
+		t.Errorf("pinned query wrong: %d %s %v", w.Code, w.Body.String(), err)
+	}
+
+	// not pinned, all routes merged.
+	req, _ = http.NewRequest("GET", "http://localhost/query?q=select+value+from+http+where+time+%3E+now()+-+1h&db=test", nil)
+	w = httptest.NewRecorder()
+	err = ic.Query(w, req)
+	want := `{"results":[{"statement_id":0,"series":[{"name":"http","tags":{"region":"eu"},"columns":["time","value"],"values":[[0,1]]},{"name":"http","tags":{"region":"us"},"columns":["time","value"],"values":[[1,1]]}]}]}`
+	if err != nil || w.Code != 200 || w.Body.String() != want {
+		t.Errorf("query wrong: %d %s %v", w.Code, w.Body.String(), err)
+	}
+
+	req, _ = http.NewRequest("GET", "http://localhost/query?q=select+mean(value)+from+http+where+time+%3E+now()+-+1h&db=test", nil)
+	w = httptest.NewRecorder()
+	if ic.Query(w, req) != ErrAggregateShard || w.Code != 400 {
+		t.Errorf("aggregation over routes: %d %s", w.Code, w.Body.String())
+	}
+}
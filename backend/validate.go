@@ -0,0 +1,277 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrNotValidatable = errors.New("config source can't be validated")
+)
+
+type ConfigIssue struct {
+	Key     string `json:"key"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// ConfigReport is the result of ValidateConfig. Errors break loading or
+// routing, warnings are legal but maybe not what you want.
+type ConfigReport struct {
+	Valid    bool          `json:"valid"`
+	Errors   []ConfigIssue `json:"errors"`
+	Warnings []ConfigIssue `json:"warnings"`
+}
+
+func (report *ConfigReport) Error(key, field, format string, args ...interface{}) {
+	report.Errors = append(report.Errors, ConfigIssue{
+		Key: key, Field: field, Message: fmt.Sprintf(format, args...)})
+	report.Valid = false
+}
+
+func (report *ConfigReport) Warning(key, field, format string, args ...interface{}) {
+	report.Warnings = append(report.Warnings, ConfigIssue{
+		Key: key, Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func structKeys(o interface{}) (keys map[string]bool) {
+	keys = make(map[string]bool)
+	t := reflect.TypeOf(o).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		keys[ConfigKey(t.Field(i))] = true
+	}
+	return
+}
+
+func structField(o interface{}, key string) (field reflect.StructField, ok bool) {
+	t := reflect.TypeOf(o).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		if ConfigKey(t.Field(i)) == key {
+			return t.Field(i), true
+		}
+	}
+	return
+}
+
+// check fields one by one, so every bad one is reported.
+func validateStruct(report *ConfigReport, key string, data map[string]string, o interface{}) {
+	known := structKeys(o)
+	for _, field := range sortedKeys(data) {
+		if !known[field] {
+			report.Warning(key, field, "unknown field")
+			continue
+		}
+		if typeField, ok := structField(o, field); ok && unsetDuration(typeField, data[field]) {
+			report.Warning(key, field, "%q not positive, default %s used", data[field], typeField.Tag.Get("default"))
+			continue
+		}
+		err := LoadStructFromMap(map[string]string{field: data[field]}, o)
+		if err != nil {
+			report.Error(key, field, "can't parse %q: %s", data[field], err)
+		}
+	}
+}
+
+func sortedKeys(m map[string]string) (keys []string) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
+
+func validateNexts(report *ConfigReport, key string, data map[string]string, raw *RawConfig) {
+	for _, name := range SplitList(data["nexts"]) {
+		if _, ok := raw.Backends[name]; !ok {
+			report.Error(key, "nexts", "backend %s not exists", name)
+		}
+	}
+}
+
+func validateFuture(report *ConfigReport, key string, data map[string]string) {
+	if action, ok := data["futureaction"]; ok && action != "reject" && action != "clamp" {
+		report.Error(key, "futureaction", "unknown action %q, reject or clamp", action)
+	}
+}
+
+// a name route matches measurements it's a prefix of.
+func isNameRoute(key string) bool {
+	_, key = SplitRouteDB(key)
+	if key == ROUTE_ANY {
+		return false
+	}
+	if match, err := CompileRoute(key); err != nil || match != nil {
+		return false
+	}
+	_, tags, err := ParseTagRoute(key)
+	return err == nil && tags == nil
+}
+
+// ValidateConfig checks raw config without applying it.
+func ValidateConfig(raw *RawConfig) (report *ConfigReport) {
+	report = &ConfigReport{
+		Valid:    true,
+		Errors:   []ConfigIssue{},
+		Warnings: []ConfigIssue{},
+	}
+
+	validateStruct(report, "default_node", raw.DefaultNode, &NodeConfig{})
+	validateNexts(report, "default_node", raw.DefaultNode, raw)
+	validateFuture(report, "default_node", raw.DefaultNode)
+
+	var names []string
+	for name := range raw.Nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		validateStruct(report, "n:"+name, raw.Nodes[name], &NodeConfig{})
+		validateNexts(report, "n:"+name, raw.Nodes[name], raw)
+		validateFuture(report, "n:"+name, raw.Nodes[name])
+	}
+
+	names = names[:0]
+	for name := range raw.Backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		key := "b:" + name
+		data := raw.Backends[name]
+		validateStruct(report, key, data, &BackendConfig{})
+
+		u, err := url.Parse(data["url"])
+		switch {
+		case data["url"] == "":
+			report.Error(key, "url", "url is empty")
+		case err != nil:
+			report.Error(key, "url", "invalid url: %s", err)
+		case u.Scheme != "http" && u.Scheme != "https":
+			report.Error(key, "url", "invalid url scheme: %q", u.Scheme)
+		case u.Host == "":
+			report.Error(key, "url", "url without host")
+		}
+	}
+
+	names = names[:0]
+	for name := range raw.Measurements {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		key := "m:" + name
+		bs_names := raw.Measurements[name]
+		if len(bs_names) == 0 {
+			report.Error(key, "", "measurement without backends")
+		}
+		if err := CheckRoute(name); err != nil {
+			report.Error(key, "", "illegal route: %s", err)
+		}
+
+		seen := make(map[string]bool)
+		groups, sharded := SplitGroups(bs_names)
+		for _, group := range groups {
+			if sharded && len(group) == 0 {
+				report.Error(key, "", "empty replica group")
+			}
+			for _, bs_name := range group {
+				if seen[bs_name] {
+					report.Warning(key, "", "duplicate backend %s", bs_name)
+				}
+				seen[bs_name] = true
+				if _, ok := raw.Backends[bs_name]; !ok {
+					report.Error(key, "", "backend %s not exists", bs_name)
+				}
+			}
+		}
+
+		// sorted, so names a prefix covers come right after it.
+		if !isNameRoute(name) {
+			continue
+		}
+		db, _ := SplitRouteDB(name)
+		for _, other := range names[i+1:] {
+			if !strings.HasPrefix(other, name) {
+				break
+			}
+			if odb, _ := SplitRouteDB(other); odb == db && isNameRoute(other) {
+				report.Warning("m:"+other, "", "overlaps with prefix m:%s, the longest prefix wins", name)
+			}
+		}
+	}
+
+	names = names[:0]
+	for name := range raw.Rewrites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		key := "r:" + name
+		data := raw.Rewrites[name]
+		validateStruct(report, key, data, &RewriteConfig{})
+
+		cfg, err := LoadRewriteConfig(data)
+		if err != nil {
+			continue
+		}
+		if _, err = NewRewriteRule(name, cfg); err != nil {
+			report.Error(key, "", "illegal rewrite: %s", err)
+			continue
+		}
+		if cfg.Rename == "" && len(cfg.RenameTags) == 0 && len(cfg.DropTags) == 0 &&
+			len(cfg.AddTags) == 0 && len(cfg.DropFields) == 0 {
+			report.Warning(key, "", "rewrite changes nothing")
+		}
+	}
+
+	names = names[:0]
+	for name := range raw.Filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		key := "f:" + name
+		data := raw.Filters[name]
+		validateStruct(report, key, data, &FilterConfig{})
+
+		cfg, err := LoadFilterConfig(data)
+		if err != nil {
+			continue
+		}
+		if _, err = NewFilterRule(name, cfg); err != nil {
+			report.Error(key, "", "illegal filter: %s", err)
+		}
+	}
+	return
+}
+
+// CheckConfigSource loads the whole config from cfgsrc and validates it.
+func CheckConfigSource(cfgsrc ConfigSource) (report *ConfigReport, err error) {
+	rcs, ok := cfgsrc.(RawConfigSource)
+	if !ok {
+		err = ErrNotValidatable
+		return
+	}
+
+	if refresher, ok := cfgsrc.(RefreshableConfigSource); ok {
+		err = refresher.Refresh()
+		if err != nil {
+			return
+		}
+	}
+
+	raw, err := rcs.LoadRaw()
+	if err != nil {
+		return
+	}
+	report = ValidateConfig(raw)
+	return
+}
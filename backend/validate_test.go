@@ -0,0 +1,100 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"os"
+	"testing"
+)
+
+func hasIssue(issues []ConfigIssue, key, field string) bool {
+	for _, issue := range issues {
+		if issue.Key == key && issue.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+func TestValidateConfig(t *testing.T) {
+	raw := NewRawConfig()
+	raw.DefaultNode = map[string]string{"listenaddr": ":6666", "nexts": "local,missing"}
+	raw.Nodes["l1"] = map[string]string{"interval": "ten", "dbs": "test", "futureaction": "drop"}
+	raw.Backends["local"] = map[string]string{"url": "http://localhost:8086", "db": "test", "checkinterval": "0"}
+	raw.Backends["bad"] = map[string]string{"url": "localhost:8086", "timeout": "ten", "maxrowlimit": "x"}
+	raw.Backends["empty"] = map[string]string{"db": "test"}
+	raw.Measurements["cpu"] = []string{"local", "local"}
+	raw.Measurements["cpu.load"] = []string{"local", "gone"}
+	raw.Measurements["cpu,host=a"] = []string{"local"}
+	raw.Measurements["mem"] = []string{}
+	raw.Measurements["re:app_("] = []string{"local"}
+	raw.Rewrites["rename"] = map[string]string{"measurement": "cpu_old", "rename": "cpu"}
+	raw.Rewrites["bad"] = map[string]string{"measurement": "cpu", "addtags": "region"}
+	raw.Rewrites["noop"] = map[string]string{"measurement": "cpu"}
+	raw.Filters["flood"] = map[string]string{"measurement": "spam"}
+	raw.Filters["bad"] = map[string]string{"addrs": "10.0.0"}
+
+	report := ValidateConfig(raw)
+	if report.Valid {
+		t.Errorf("invalid config passed")
+	}
+
+	errors := []struct{ key, field string }{
+		{"default_node", "nexts"},
+		{"n:l1", "interval"},
+		{"n:l1", "futureaction"},
+		{"b:bad", "url"},
+		{"b:bad", "timeout"},
+		{"b:bad", "maxrowlimit"},
+		{"b:empty", "url"},
+		{"m:cpu.load", ""},
+		{"m:mem", ""},
+		{"m:re:app_(", ""},
+		{"r:bad", ""},
+		{"f:bad", ""},
+	}
+	for _, e := range errors {
+		if !hasIssue(report.Errors, e.key, e.field) {
+			t.Errorf("error not reported: %s %s", e.key, e.field)
+		}
+	}
+	if len(report.Errors) != len(errors) {
+		t.Errorf("wrong errors: %v", report.Errors)
+	}
+
+	warnings := []struct{ key, field string }{
+		{"n:l1", "dbs"},
+		{"b:local", "checkinterval"},
+		{"m:cpu", ""},
+		{"m:cpu.load", ""},
+		{"r:noop", ""},
+	}
+	for _, w := range warnings {
+		if !hasIssue(report.Warnings, w.key, w.field) {
+			t.Errorf("warning not reported: %s %s", w.key, w.field)
+		}
+	}
+	if len(report.Warnings) != len(warnings) {
+		t.Errorf("wrong warnings: %v", report.Warnings)
+	}
+}
+
+func TestCheckConfigSource(t *testing.T) {
+	filename := CreateTestConfigFile(t, "json", testConfigFiles["json"])
+	defer os.Remove(filename)
+
+	report, err := CheckConfigSource(NewFileConfigSource(filename, "l1"))
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if !report.Valid || len(report.Warnings) != 0 {
+		t.Errorf("valid config failed: %+v", report)
+	}
+
+	_, err = CheckConfigSource(&StaticConfigSource{})
+	if err != ErrNotValidatable {
+		t.Errorf("source without raw config validated: %v", err)
+	}
+}
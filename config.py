@@ -17,13 +17,17 @@ import redis
 # url: influxdb addr or other http backend which supports influxdb line protocol
 # db: influxdb db 
 # zone: same zone first query
+# durations are numbers in ms, or strings like '10s'
 # interval: default config is 1000ms, wait 1 second write whether point count has bigger than maxrowlimit config
 # timeout: default config is 10000ms, write timeout until 10 seconds
 # timeoutquery: default config is 600000ms, query timeout until 600 seconds
 # maxrowlimit: default config is 10000, wait 10000 points write 
 # checkinterval: default config is 1000ms, check backend active every 1 second
 # rewriteinterval: default config is 10000ms, rewrite every 10 seconds
-# writeonly: default 0
+# writeonly: default 0, 1 or true to enable
+# autocreate: default 0, 1 or true to create db when a write finds it not exists
+# autocreaterp: name of default retention policy of db created, none by default
+# autocreateduration: duration of that retention policy, default 0 for infinite
 BACKENDS = {
     'local': {
         'url': 'http://localhost:8086', 
@@ -45,20 +49,46 @@ BACKENDS = {
 
 # measurement:[backends keys], the key must be in the BACKENDS
 # data with the measurement will write to the backends
+# keys may be 're:<regexp>', 'glob:<pattern>', or tag routes like 'http,region=eu'
+# 'db:<database>/' before the key, like 'db:mydb/cpu', makes it only for client database mydb
+# '*' catches measurements no other key matches, 'db:mydb/*' the same for mydb
+# items with ',' make it sharded, every item is a replica group:
+#   'cpu': ['local,local2', 'local3,local4']
 KEYMAPS = {
     'cpu': ['local'],
     'temperature': ['local2']
 }
 
+# rewrite rules, applied to points before routing, in order of names
+# measurement: name, 're:<regexp>', 'glob:<pattern>' or '*' for all
+# db: only points written to this client database
+# rename: new measurement, may use submatches of a 're:' measurement, like 'svc_$1'
+# renametags, addtags: pairs split with ',', like 'hostname=host'
+# droptags, dropfields: keys split with ','
+REWRITES = {
+}
+
+# filter rules, points matching all conditions set in any rule are dropped
+# measurement: name, 're:<regexp>', 'glob:<pattern>' or '*' for all
+# db: client database
+# tags: keys or pairs like 'region=eu' split with ','
+# fields: keys split with ','
+# addrs: client ips or cidrs split with ','
+FILTERS = {
+}
+
 # this config will cover default_node config
 # listenaddr: proxy listen addr                
-# db: proxy db, client's db must be same with it
+# db: proxy db, client's db must be same with it, or have routes like 'db:mydb/cpu'
 # zone: use for query
 # nexts: the backends keys, will accept all data, split with ','
-# interval: collect Statistics
-# idletimeout: keep-alives wait time 
+# interval: collect Statistics, numbers in seconds, or strings like '1m'
+# idletimeout: keep-alives wait time, numbers in seconds, or strings like '1m'
 # writetracing: enable logging for the write,default is 0
 # querytracing: enable logging for the query,default is 0
+# autoregister: record measurements without route in redis set 'unrouted', default is 0
+# futurelimit: points later than this in the future are rejected, numbers in seconds, 0 for no limit
+# futureaction: 'reject' or 'clamp' to the limit, default is 'reject'
 NODES = {
     'l1': { 
         'listenaddr': ':6666',
@@ -110,12 +140,16 @@ def main():
         port=int(optdict.get('-p', '6379')),
         db=int(optdict.get('-d', '0')))
 
-    cleanups(client, ['default_node', 'b:*', 'm:*', 'n:*'])
+    cleanups(client, ['default_node', 'b:*', 'm:*', 'n:*', 'r:*', 'f:*'])
 
     write_config(client, DEFAULT_NODE, "default_node")
     write_configs(client, BACKENDS, 'b:')
     write_configs(client, NODES, 'n:')
     write_configs(client, KEYMAPS, 'm:')
+    write_configs(client, REWRITES, 'r:')
+    write_configs(client, FILTERS, 'f:')
+    # proxies reload by keyspace notifications, this one works without them.
+    client.publish('influx-proxy:reload', 'config.py')
 
 
 if __name__ == '__main__':
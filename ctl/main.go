@@ -0,0 +1,236 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// influx-proxy-ctl manages config of influx-proxy in redis.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	redis "gopkg.in/redis.v5"
+
+	"github.com/eleme/influx-proxy/backend"
+)
+
+var (
+	RedisAddr     string
+	RedisPassword string
+	RedisDB       int
+	Nodes         string
+	Force         bool
+)
+
+func init() {
+	flag.StringVar(&RedisAddr, "redis", "localhost:6379", "redis addr")
+	flag.StringVar(&RedisPassword, "redis-password", "", "redis password")
+	flag.IntVar(&RedisDB, "redis-db", 0, "redis db")
+	flag.StringVar(&Nodes, "nodes", "", "proxies to reload after apply, like http://127.0.0.1:6666, split with ','")
+	flag.BoolVar(&Force, "force", false, "apply even if config is invalid")
+	flag.Usage = usage
+	flag.Parse()
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: influx-proxy-ctl [options] command [args]
+
+commands:
+  export [file]   write config in redis to file (json, yaml or toml), or stdout
+  diff file       show changes from config in redis to file
+  apply file      validate file and replace config in redis with it atomically
+  versions        list versions can be rolled back to, and the live one
+  rollback ver    make snapshot of version ver the live config
+  reload [node]   call /reload on nodes, default is -nodes
+
+options:
+`)
+	flag.PrintDefaults()
+}
+
+func exit(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
+
+func loadFile(filename string) (raw *backend.RawConfig) {
+	raw, err := backend.NewFileConfigSource(filename, "").LoadRaw()
+	if err != nil {
+		exit("load %s failed: %s", filename, err)
+	}
+	return
+}
+
+func export(rcs *backend.RedisConfigSource, filename string) {
+	raw, err := rcs.LoadRaw()
+	if err != nil {
+		exit("load redis failed: %s", err)
+	}
+
+	format := "json"
+	if filename != "" {
+		format = backend.FileFormat(filename)
+	}
+	p, err := backend.MarshalRawConfig(raw, format)
+	if err != nil {
+		exit("export failed: %s", err)
+	}
+
+	if filename == "" {
+		os.Stdout.Write(p)
+		return
+	}
+	err = ioutil.WriteFile(filename, p, 0644)
+	if err != nil {
+		exit("write %s failed: %s", filename, err)
+	}
+}
+
+func diff(rcs *backend.RedisConfigSource, filename string) (changed bool) {
+	orig, err := rcs.LoadRaw()
+	if err != nil {
+		exit("load redis failed: %s", err)
+	}
+
+	diffs := backend.DiffRawConfig(orig, loadFile(filename))
+	for _, d := range diffs {
+		fmt.Println(d)
+	}
+	return len(diffs) > 0
+}
+
+func apply(rcs *backend.RedisConfigSource, filename string) {
+	raw := loadFile(filename)
+
+	report := backend.ValidateConfig(raw)
+	for _, issue := range report.Warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s %s: %s\n", issue.Key, issue.Field, issue.Message)
+	}
+	for _, issue := range report.Errors {
+		fmt.Fprintf(os.Stderr, "error: %s %s: %s\n", issue.Key, issue.Field, issue.Message)
+	}
+	if !report.Valid && !Force {
+		exit("config invalid, not applied.")
+	}
+
+	if !diff(rcs, filename) {
+		fmt.Println("nothing changed.")
+		return
+	}
+
+	version, err := rcs.Apply(raw)
+	if err != nil {
+		exit("apply failed: %s", err)
+	}
+	fmt.Printf("applied as version %d.\n", version)
+
+	if Nodes != "" {
+		reload(strings.Split(Nodes, ","))
+	}
+}
+
+func versions(rcs *backend.RedisConfigSource) {
+	live, err := rcs.Version()
+	if err != nil {
+		exit("load redis failed: %s", err)
+	}
+
+	vers, err := rcs.Versions()
+	if err != nil {
+		exit("load redis failed: %s", err)
+	}
+	for _, v := range vers {
+		if v == live {
+			fmt.Printf("%d (live)\n", v)
+			continue
+		}
+		fmt.Println(v)
+	}
+}
+
+func rollback(rcs *backend.RedisConfigSource, version string) {
+	v, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		exit("illegal version: %s", version)
+	}
+
+	err = rcs.Rollback(v)
+	if err != nil {
+		exit("rollback failed: %s", err)
+	}
+	fmt.Printf("rolled back to version %d.\n", v)
+
+	if Nodes != "" {
+		reload(strings.Split(Nodes, ","))
+	}
+}
+
+func reload(nodes []string) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	failed := false
+	for _, node := range nodes {
+		resp, err := client.Post(strings.TrimRight(node, "/")+"/reload", "", nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reload %s failed: %s\n", node, err)
+			failed = true
+			continue
+		}
+		p, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 204 {
+			fmt.Fprintf(os.Stderr, "reload %s failed: %d %s\n", node, resp.StatusCode, p)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s reloaded.\n", node)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func main() {
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	rcs := backend.NewRedisConfigSource(&redis.Options{
+		Addr:     RedisAddr,
+		Password: RedisPassword,
+		DB:       RedisDB,
+	}, "")
+
+	switch {
+	case args[0] == "export" && len(args) <= 2:
+		var filename string
+		if len(args) == 2 {
+			filename = args[1]
+		}
+		export(rcs, filename)
+	case args[0] == "diff" && len(args) == 2:
+		diff(rcs, args[1])
+	case args[0] == "apply" && len(args) == 2:
+		apply(rcs, args[1])
+	case args[0] == "versions" && len(args) == 1:
+		versions(rcs)
+	case args[0] == "rollback" && len(args) == 2:
+		rollback(rcs, args[1])
+	case args[0] == "reload":
+		nodes := args[1:]
+		if len(nodes) == 0 && Nodes != "" {
+			nodes = strings.Split(Nodes, ",")
+		}
+		reload(nodes)
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
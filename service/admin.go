@@ -0,0 +1,339 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/eleme/influx-proxy/backend"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrExists   = errors.New("already exists")
+)
+
+// RegisterAdmin adds the admin api on /api/backends[/<name>] and
+// /api/measurements[/<name>]. GET lists or shows, POST creates, PUT
+// replaces an existing one and DELETE removes. A backend is a json object
+// of its fields, a measurement is a json array of backend names. Changes
+// are saved to config source and loaded at once. /api/unrouted lists
+// measurements seen without a route, DELETE /api/unrouted/<name> dismisses
+// one. /api/deadletters[/<backend>[/<id>]] lists dead letters, or gives
+// lines of one; DELETE purges, POST replays them.
+func (hs *HttpService) RegisterAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("/api/backends", hs.HandlerBackends)
+	mux.HandleFunc("/api/backends/", hs.HandlerBackends)
+	mux.HandleFunc("/api/measurements", hs.HandlerMeasurements)
+	mux.HandleFunc("/api/measurements/", hs.HandlerMeasurements)
+	mux.HandleFunc("/api/unrouted", hs.HandlerUnrouted)
+	mux.HandleFunc("/api/unrouted/", hs.HandlerUnrouted)
+	mux.HandleFunc("/api/deadletters", hs.HandlerDeadLetters)
+	mux.HandleFunc("/api/deadletters/", hs.HandlerDeadLetters)
+}
+
+func writeJson(w http.ResponseWriter, code int, v interface{}) {
+	p, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(p)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*backend.LetterNotFoundError); ok {
+		w.WriteHeader(404)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	switch err {
+	case ErrNotFound, backend.ErrBackendNotExist, backend.ErrLetterNotFound:
+		w.WriteHeader(404)
+	case ErrExists:
+		w.WriteHeader(409)
+	case backend.ErrNotWritable, backend.ErrNotValidatable:
+		w.WriteHeader(501)
+	default:
+		w.WriteHeader(500)
+	}
+	w.Write([]byte(err.Error()))
+}
+
+// name of object in path, "" for the collection.
+func adminName(req *http.Request, prefix string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, prefix), "/")
+}
+
+func (hs *HttpService) HandlerBackends(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	w.Header().Add("X-Influxdb-Version", backend.VERSION)
+
+	name := adminName(req, "/api/backends")
+	if req.Method == "GET" {
+		raw, err := hs.ic.RawConfig()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if name == "" {
+			writeJson(w, 200, raw.Backends)
+			return
+		}
+		data, ok := raw.Backends[name]
+		if !ok {
+			writeError(w, ErrNotFound)
+			return
+		}
+		writeJson(w, 200, data)
+		return
+	}
+
+	if name == "" {
+		w.WriteHeader(405)
+		w.Write([]byte("method not allow."))
+		return
+	}
+
+	var data map[string]string
+	if req.Method == "POST" || req.Method == "PUT" {
+		p, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		data, err = backend.ParseConfigData(p)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("illegal backend: " + err.Error()))
+			return
+		}
+	}
+
+	hs.update(w, req.Method, data, func(raw *backend.RawConfig) (err error) {
+		_, ok := raw.Backends[name]
+		switch {
+		case req.Method == "POST" && ok:
+			return ErrExists
+		case req.Method != "POST" && !ok:
+			return ErrNotFound
+		case req.Method == "DELETE":
+			delete(raw.Backends, name)
+		default:
+			raw.Backends[name] = data
+		}
+		return
+	})
+}
+
+func (hs *HttpService) HandlerMeasurements(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	w.Header().Add("X-Influxdb-Version", backend.VERSION)
+
+	name := adminName(req, "/api/measurements")
+	if req.Method == "GET" {
+		raw, err := hs.ic.RawConfig()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if name == "" {
+			writeJson(w, 200, raw.Measurements)
+			return
+		}
+		bs_names, ok := raw.Measurements[name]
+		if !ok {
+			writeError(w, ErrNotFound)
+			return
+		}
+		writeJson(w, 200, bs_names)
+		return
+	}
+
+	if name == "" {
+		w.WriteHeader(405)
+		w.Write([]byte("method not allow."))
+		return
+	}
+
+	var bs_names []string
+	if req.Method == "POST" || req.Method == "PUT" {
+		err := json.NewDecoder(req.Body).Decode(&bs_names)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("illegal measurement: " + err.Error()))
+			return
+		}
+	}
+
+	hs.update(w, req.Method, bs_names, func(raw *backend.RawConfig) (err error) {
+		_, ok := raw.Measurements[name]
+		switch {
+		case req.Method == "POST" && ok:
+			return ErrExists
+		case req.Method != "POST" && !ok:
+			return ErrNotFound
+		case req.Method == "DELETE":
+			delete(raw.Measurements, name)
+		default:
+			raw.Measurements[name] = bs_names
+		}
+		return
+	})
+}
+
+func (hs *HttpService) HandlerUnrouted(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	w.Header().Add("X-Influxdb-Version", backend.VERSION)
+
+	name := adminName(req, "/api/unrouted")
+	switch {
+	case req.Method == "GET" && name == "":
+		names, err := hs.ic.Unrouted()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if names == nil {
+			names = []string{}
+		}
+		writeJson(w, 200, names)
+	case req.Method == "DELETE" && name != "":
+		err := hs.ic.DismissUnrouted(name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	default:
+		w.WriteHeader(405)
+		w.Write([]byte("method not allow."))
+	}
+}
+
+func (hs *HttpService) HandlerDeadLetters(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	w.Header().Add("X-Influxdb-Version", backend.VERSION)
+
+	name := adminName(req, "/api/deadletters")
+	if name == "" {
+		if req.Method != "GET" {
+			w.WriteHeader(405)
+			w.Write([]byte("method not allow."))
+			return
+		}
+		letters, err := hs.ic.DeadLetters()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJson(w, 200, letters)
+		return
+	}
+
+	var ids []int64
+	if i := strings.IndexByte(name, '/'); i != -1 {
+		id, err := strconv.ParseInt(name[i+1:], 10, 64)
+		if err != nil {
+			writeError(w, backend.ErrLetterNotFound)
+			return
+		}
+		ids = append(ids, id)
+		name = name[:i]
+	}
+	bs, err := hs.ic.BackendsOf(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	dl := bs.DeadLetters()
+
+	switch req.Method {
+	case "GET":
+		if len(ids) == 0 {
+			letters, err := dl.List()
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			for _, letter := range letters {
+				letter.Lines = ""
+			}
+			if letters == nil {
+				letters = []*backend.Letter{}
+			}
+			writeJson(w, 200, letters)
+			return
+		}
+		letter, err := dl.Get(ids[0])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename="+name+"-"+strconv.FormatInt(letter.ID, 10)+".txt")
+		w.WriteHeader(200)
+		w.Write([]byte(letter.Lines))
+	case "DELETE":
+		err = dl.Remove(ids...)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	case "POST":
+		replayed, failed, err := bs.Replay(ids...)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJson(w, 200, map[string]int{"replayed": replayed, "failed": failed})
+	default:
+		w.WriteHeader(405)
+		w.Write([]byte("method not allow."))
+	}
+}
+
+// update config by fn, reply with the new value, or report if invalid.
+func (hs *HttpService) update(w http.ResponseWriter, method string, value interface{}, fn func(raw *backend.RawConfig) error) {
+	switch method {
+	case "POST", "PUT", "DELETE":
+	default:
+		w.WriteHeader(405)
+		w.Write([]byte("method not allow."))
+		return
+	}
+
+	report, err := hs.ic.UpdateConfig(fn)
+	if err == backend.ErrIllegalConfig {
+		writeJson(w, 400, report)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Add("X-Influx-Proxy-Config-Version", strconv.FormatInt(hs.ic.Version(), 10))
+	switch method {
+	case "POST":
+		writeJson(w, 201, value)
+	case "PUT":
+		writeJson(w, 200, value)
+	default:
+		w.WriteHeader(204)
+	}
+}
@@ -6,10 +6,13 @@ package main
 
 import (
 	"compress/gzip"
+	"encoding/json"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/pprof"
+	"strconv"
 	"strings"
 
 	"github.com/eleme/influx-proxy/backend"
@@ -31,11 +34,19 @@ func NewHttpService(ic *backend.InfluxCluster, db string) (hs *HttpService) {
 	return
 }
 
+// the node db, and databases with their own routes. any if db not set.
+func (hs *HttpService) acceptDB(db string) bool {
+	return hs.db == "" || db == hs.db || hs.ic.HasDB(db)
+}
+
 func (hs *HttpService) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/reload", hs.HandlerReload)
+	mux.HandleFunc("/config/validate", hs.HandlerValidate)
 	mux.HandleFunc("/ping", hs.HandlerPing)
+	mux.HandleFunc("/status", hs.HandlerStatus)
 	mux.HandleFunc("/query", hs.HandlerQuery)
 	mux.HandleFunc("/write", hs.HandlerWrite)
+	hs.RegisterAdmin(mux)
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 }
@@ -44,17 +55,84 @@ func (hs *HttpService) HandlerReload(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 	w.Header().Add("X-Influxdb-Version", backend.VERSION)
 
-	err := hs.ic.LoadConfig()
+	var err error
+	if version := req.FormValue("version"); version != "" {
+		var v int64
+		v, err = strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("illegal version"))
+			return
+		}
+		err = hs.ic.Rollback(v)
+	} else {
+		err = hs.ic.LoadConfig()
+	}
 	if err != nil {
 		w.WriteHeader(400)
 		w.Write([]byte(err.Error()))
 		return
 	}
 
+	w.Header().Add("X-Influx-Proxy-Config-Version", strconv.FormatInt(hs.ic.Version(), 10))
 	w.WriteHeader(204)
 	return
 }
 
+// HandlerStatus shows version of config running, and points touched by
+// every rewrite and filter rule.
+func (hs *HttpService) HandlerStatus(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	w.Header().Add("X-Influxdb-Version", backend.VERSION)
+
+	p, err := json.Marshal(map[string]interface{}{
+		"version":        backend.VERSION,
+		"config_version": hs.ic.Version(),
+		"rewrites":       hs.ic.RewriteCounts(),
+		"filters":        hs.ic.DropCounts(),
+	})
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(p)
+	return
+}
+
+// HandlerValidate checks config in source without applying it.
+// 200 if it's valid, 400 if not, report in body.
+func (hs *HttpService) HandlerValidate(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	w.Header().Add("X-Influxdb-Version", backend.VERSION)
+
+	report, err := hs.ic.ValidateConfig()
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	p, err := json.Marshal(report)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Valid {
+		w.WriteHeader(200)
+	} else {
+		w.WriteHeader(400)
+	}
+	w.Write(p)
+	return
+}
+
 func (hs *HttpService) HandlerPing(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 	version, err := hs.ic.Ping()
@@ -63,6 +141,7 @@ func (hs *HttpService) HandlerPing(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	w.Header().Add("X-Influxdb-Version", version)
+	w.Header().Add("X-Influx-Proxy-Config-Version", strconv.FormatInt(hs.ic.Version(), 10))
 	w.WriteHeader(204)
 	return
 }
@@ -72,12 +151,10 @@ func (hs *HttpService) HandlerQuery(w http.ResponseWriter, req *http.Request) {
 	w.Header().Add("X-Influxdb-Version", backend.VERSION)
 
 	db := req.FormValue("db")
-	if hs.db != "" {
-		if db != hs.db {
-			w.WriteHeader(404)
-			w.Write([]byte("database not exist."))
-			return
-		}
+	if !hs.acceptDB(db) {
+		w.WriteHeader(404)
+		w.Write([]byte("database not exist."))
+		return
 	}
 
 	q := strings.TrimSpace(req.FormValue("q"))
@@ -86,13 +163,20 @@ func (hs *HttpService) HandlerQuery(w http.ResponseWriter, req *http.Request) {
 		log.Printf("query error: %s,the query is %s,the client is %s\n", err, q, req.RemoteAddr)
 		return
 	}
-	if hs.ic.QueryTracing != 0 {
+	if hs.ic.QueryTracing {
 		log.Printf("the query is %s,the client is %s\n", q, req.RemoteAddr)
 	}
 
 	return
 }
 
+// writeFailure is the body of a write not all written, error like influxdb
+// with counts of points.
+type writeFailure struct {
+	Error string `json:"error"`
+	*backend.WriteResult
+}
+
 func (hs *HttpService) HandlerWrite(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 	w.Header().Add("X-Influxdb-Version", backend.VERSION)
@@ -103,14 +187,20 @@ func (hs *HttpService) HandlerWrite(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	db := req.URL.Query().Get("db")
-
-	if hs.db != "" {
-		if db != hs.db {
-			w.WriteHeader(404)
-			w.Write([]byte("database not exist."))
-			return
-		}
+	params, err := backend.ParseWriteParams(req.URL.Query())
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !hs.acceptDB(params.DB) {
+		w.WriteHeader(404)
+		w.Write([]byte("database not exist."))
+		return
+	}
+	params.Addr, _, err = net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		params.Addr = req.RemoteAddr
 	}
 
 	body := req.Body
@@ -132,11 +222,19 @@ func (hs *HttpService) HandlerWrite(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = hs.ic.Write(p)
+	result, err := hs.ic.Write(p, params)
 	if err == nil {
+		err = result.Err()
+	}
+	switch err.(type) {
+	case nil:
 		w.WriteHeader(204)
+	case *backend.PartialWriteError:
+		writeJson(w, 400, &writeFailure{Error: err.Error(), WriteResult: result})
+	default:
+		writeJson(w, 500, &writeFailure{Error: err.Error(), WriteResult: result})
 	}
-	if hs.ic.WriteTracing != 0 {
+	if hs.ic.WriteTracing {
 		log.Printf("Write body received by handler: %s,the client is %s\n", p, req.RemoteAddr)
 	}
 	return
@@ -8,9 +8,12 @@ import (
 	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"reflect"
+	"strings"
 	"time"
 
 	lumberjack "gopkg.in/natefinch/lumberjack.v2"
@@ -24,9 +27,37 @@ var (
 	ConfigFile  string
 	NodeName    string
 	RedisAddr   string
+	SourceFile  string
+	SourceURL   string
+	SourcePoll  time.Duration
 	LogFilePath string
+	Watch       bool
+	WatchDelay  time.Duration
+	CheckConfig bool
+	NodeFlags   = make(map[string]*nodeFlag)
 )
 
+// nodeFlag overrides a field of node config, only when set.
+type nodeFlag struct {
+	value  string
+	isBool bool
+	set    bool
+}
+
+func (nf *nodeFlag) String() string {
+	return nf.value
+}
+
+func (nf *nodeFlag) Set(s string) error {
+	nf.value = s
+	nf.set = true
+	return nil
+}
+
+func (nf *nodeFlag) IsBoolFlag() bool {
+	return nf.isBool
+}
+
 func init() {
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds | log.Lshortfile)
 
@@ -34,6 +65,19 @@ func init() {
 	flag.StringVar(&ConfigFile, "config", "", "config file")
 	flag.StringVar(&NodeName, "node", "l1", "node name")
 	flag.StringVar(&RedisAddr, "redis", "localhost:6379", "config file")
+	flag.StringVar(&SourceFile, "source-file", "", "load nodes, backends and measurements from json/yaml/toml file instead of redis")
+	flag.StringVar(&SourceURL, "source-url", "", "load nodes, backends and measurements from url, same layout as -source-file")
+	flag.DurationVar(&SourcePoll, "source-poll", 10*time.Second, "interval to poll -source-url for changes")
+	flag.BoolVar(&Watch, "watch", true, "reload when config source changed")
+	flag.DurationVar(&WatchDelay, "watch-delay", time.Second, "changes in this delay cause only one reload")
+	flag.BoolVar(&CheckConfig, "check-config", false, "validate config in source, print report and exit")
+	typ := reflect.TypeOf(backend.NodeConfig{})
+	for i := 0; i < typ.NumField(); i++ {
+		key := backend.ConfigKey(typ.Field(i))
+		nf := &nodeFlag{isBool: typ.Field(i).Type.Kind() == reflect.Bool}
+		NodeFlags[key] = nf
+		flag.Var(nf, key, fmt.Sprintf("override %s of node config, also by env %s%s", key, backend.ENV_PREFIX, strings.ToUpper(key)))
+	}
 	flag.Parse()
 }
 
@@ -67,6 +111,45 @@ func initLog() {
 	}
 }
 
+// print report to stdout, return exit code.
+func checkConfig(cfgsrc backend.ConfigSource) int {
+	report, err := backend.CheckConfigSource(cfgsrc)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "load config failed: %s\n", err)
+		return 2
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "    ")
+	err = enc.Encode(report)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 2
+	}
+
+	if !report.Valid {
+		return 1
+	}
+	return 0
+}
+
+// node config from source, overridden by env, then by flags.
+func loadNodeConfig(cfgsrc backend.ConfigSource) (nodecfg backend.NodeConfig, err error) {
+	flags := backend.ConfigLayer{Name: "flag", Data: make(map[string]string)}
+	for key, nf := range NodeFlags {
+		if nf.set {
+			flags.Data[key] = nf.value
+		}
+	}
+
+	nodecfg, origins, err := backend.LoadNodeWithOverrides(cfgsrc, backend.EnvLayer(), flags)
+	if err != nil {
+		return
+	}
+	log.Printf("node config: %s", backend.DescribeNodeConfig(&nodecfg, origins))
+	return
+}
+
 func main() {
 	initLog()
 
@@ -90,17 +173,36 @@ func main() {
 		cfg.Addr = RedisAddr
 	}
 
-	rcs := backend.NewRedisConfigSource(&cfg.Options, cfg.Node)
+	var cfgsrc backend.ConfigSource
+	switch {
+	case SourceFile != "":
+		cfgsrc = backend.NewFileConfigSource(SourceFile, cfg.Node)
+	case SourceURL != "":
+		cfgsrc = backend.NewHttpConfigSource(SourceURL, cfg.Node, SourcePoll)
+	default:
+		cfgsrc = backend.NewRedisConfigSource(&cfg.Options, cfg.Node)
+	}
+
+	if CheckConfig {
+		os.Exit(checkConfig(cfgsrc))
+	}
 
-	nodecfg, err := rcs.LoadNode()
+	nodecfg, err := loadNodeConfig(cfgsrc)
 	if err != nil {
 		log.Printf("config source load failed.")
 		return
 	}
 
-	ic := backend.NewInfluxCluster(rcs, &nodecfg)
+	ic := backend.NewInfluxCluster(cfgsrc, &nodecfg)
 	ic.LoadConfig()
 
+	if Watch {
+		err = ic.WatchConfig(WatchDelay)
+		if err != nil {
+			log.Printf("watch config failed: %s", err)
+		}
+	}
+
 	mux := http.NewServeMux()
 	NewHttpService(ic, nodecfg.DB).Register(mux)
 
@@ -108,10 +210,7 @@ func main() {
 	server := &http.Server{
 		Addr:        nodecfg.ListenAddr,
 		Handler:     mux,
-		IdleTimeout: time.Duration(nodecfg.IdleTimeout) * time.Second,
-	}
-	if nodecfg.IdleTimeout <= 0 {
-		server.IdleTimeout = 10 * time.Second
+		IdleTimeout: nodecfg.IdleTimeout,
 	}
 	err = server.ListenAndServe()
 	if err != nil {